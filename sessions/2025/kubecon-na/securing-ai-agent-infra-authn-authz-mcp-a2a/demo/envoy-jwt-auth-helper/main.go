@@ -5,34 +5,152 @@ import (
     "errors"
     "flag"
     "fmt"
-    "log"
+    "io"
     "net"
+    "net/http"
     "os"
     "os/signal"
     "syscall"
     "time"
 
     authpb "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
     "google.golang.org/grpc"
+    "google.golang.org/grpc/grpclog"
+    "google.golang.org/grpc/health/grpc_health_v1"
+    "google.golang.org/grpc/status"
 
     myauth "github.com/spiffe/envoy-jwt-auth-helper/pkg/auth"
+    "github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
     "github.com/hashicorp/hcl"
     "github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 type Config struct {
-    Listen                  string `hcl:"listen"`
-    Mode                    string `hcl:"mode"`
+    Listen                  string                     `hcl:"listen"`
+    Mode                    string                     `hcl:"mode"`
+    DownstreamAudience      string                     `hcl:"downstream_audience"`
+    SVIDAudienceForKeycloak string                     `hcl:"svid_audience_for_keycloak"`
+    KeycloakTokenEndpoint   string                     `hcl:"keycloak_token_endpoint"`
+    Providers               map[string]*ProviderConfig `hcl:"provider"`
+    WorkloadSocket          string                     `hcl:"workload_socket"`
+    AdminListen             string                     `hcl:"admin_listen"`
+    TLS                     *TLSConfig                 `hcl:"tls"`
+    Log                     *LogConfig                 `hcl:"log"`
+    Cache                   *CacheConfig               `hcl:"cache"`
+    JWT                     *JWTValidationConfig       `hcl:"jwt"`
+    UMA                     *UMAConfig                 `hcl:"uma"`
+    Resilience              *ResilienceConfig          `hcl:"resilience"`
+    Tracing                 *TracingConfig             `hcl:"tracing"`
+}
+
+// ResilienceConfig bounds doPost's retry-with-backoff and per-endpoint
+// circuit breaking around every outbound Keycloak call (see
+// myauth.ResilienceConfig). MaxRetries and BaseDelay shape the retry:
+// BaseDelay is a Go duration string, doubled (with full jitter) on each of
+// up to MaxRetries additional attempts. FailureThreshold, Window and
+// Cooldown shape the breaker: it opens after FailureThreshold failures
+// within Window, and half-opens after Cooldown. Zero/empty fields take
+// myauth.NewAuthServer's defaults.
+type ResilienceConfig struct {
+    MaxRetries       int    `hcl:"max_retries"`
+    BaseDelay        string `hcl:"base_delay"`
+    FailureThreshold int    `hcl:"failure_threshold"`
+    Window           string `hcl:"window"`
+    Cooldown         string `hcl:"cooldown"`
+}
+
+// JWTValidationConfig controls full JWT signature verification via OIDC
+// discovery + JWKS in access_token_validator_with_decision mode (see
+// myauth.JWKSConfig). ExpectedIssuers is the accepted iss allow-list; when
+// empty, the issuer published in the provider's own discovery document is
+// trusted instead. ExpectedAZPs is the accepted azp allow-list - the
+// client id(s) a token may have originally been issued to (e.g. a
+// frontend SPA's Keycloak client id) - which is unrelated to this
+// resource server's own client id (svid_audience_for_keycloak /
+// ProviderConfig.SVIDAudienceForKeycloak, checked as aud); when empty, azp
+// is left unchecked. ClockSkew and MinRefreshInterval are Go duration
+// strings; MinRefreshInterval also rate-limits the on-demand JWKS refresh
+// triggered by an unrecognized kid.
+type JWTValidationConfig struct {
+    ExpectedIssuers    []string `hcl:"expected_issuers"`
+    ExpectedAZPs       []string `hcl:"expected_azp"`
+    ClockSkew          string   `hcl:"clock_skew"`
+    MinRefreshInterval string   `hcl:"min_refresh_interval"`
+}
+
+// UMAConfig controls the UMA 2.0 permission-ticket challenge flow in
+// access_token_validator_with_decision mode (see myauth.AuthServer's
+// umaTicketChallenge field). When TicketChallenge is false (the default),
+// a denied decision is reported to Envoy as a plain 403, as before. When
+// true, a denied decision instead fetches a permission ticket from the
+// provider's UMA protection API and responds 401 with a
+// `WWW-Authenticate: UMA ...` challenge, so a client that understands UMA
+// can exchange the ticket for an RPT and retry.
+type UMAConfig struct {
+    TicketChallenge bool `hcl:"ticket_challenge"`
+}
+
+// CacheConfig bounds the in-memory cache of exchanged downstream tokens
+// (access_token_exchanger mode only). The cache is enabled by default; set
+// Disabled to always hit Keycloak instead (e.g. while diagnosing a
+// staleness issue). MaxEntries is the LRU size limit (<= 0 means
+// unbounded). MinTTL and Leeway are Go duration strings (e.g. "30s", "5m"):
+// an exchanged token is cached only if its expires_in, minus Leeway, is
+// still at least MinTTL - short-lived tokens aren't worth the bookkeeping.
+type CacheConfig struct {
+    Disabled   bool   `hcl:"disabled"`
+    MaxEntries int    `hcl:"max_entries"`
+    MinTTL     string `hcl:"min_ttl"`
+    Leeway     string `hcl:"leeway"`
+}
+
+// ProviderConfig declares one RFC 8693 token-exchange / UMA target, e.g.:
+//
+//	provider "idp-a" {
+//	  authority       = "a.example.com"
+//	  discovery_url   = "https://idp-a.example.com/.well-known/openid-configuration"
+//	  svid_audience_for_keycloak = "frontend-a"
+//	  downstream_audience        = "backend-a"
+//	}
+//
+// Authority matches the caller's :authority/Host header; a provider with an
+// empty Authority (or the sole provider, if only one is declared) is used
+// as the fallback. DownstreamAudience and SVIDAudienceForKeycloak mirror the
+// top-level fields of the same name, scoped per provider. TokenEndpoint is
+// used as-is when neither Issuer nor DiscoveryURL is set; otherwise it (and
+// the JWKS this helper verifies access tokens against, in
+// access_token_validator_with_decision mode) is resolved - and kept fresh -
+// from the provider's OIDC discovery document. Issuer is the preferred way
+// to point at a discovery document (the well-known suffix is appended for
+// you); DiscoveryURL is a legacy escape hatch for providers whose discovery
+// document does not live at the standard well-known path.
+//
+// When no provider blocks are declared, validate synthesizes a single
+// "default" provider from the legacy top-level downstream_audience /
+// svid_audience_for_keycloak / keycloak_token_endpoint fields, so existing
+// single-IdP configs keep working unchanged.
+type ProviderConfig struct {
+    Authority               string `hcl:"authority"`
     DownstreamAudience      string `hcl:"downstream_audience"`
     SVIDAudienceForKeycloak string `hcl:"svid_audience_for_keycloak"`
-    KeycloakTokenEndpoint   string `hcl:"keycloak_token_endpoint"`
-    WorkloadSocket          string `hcl:"workload_socket"`
+    TokenEndpoint           string `hcl:"token_endpoint"`
+    Issuer                  string `hcl:"issuer"`
+    DiscoveryURL            string `hcl:"discovery_url"`
+}
+
+// LogConfig controls the structured logger. Level is one of zerolog's
+// level names ("debug", "info", "warn", "error", ...); Format is "text"
+// (human-readable, the default) or "json" (for log-aggregation pipelines).
+type LogConfig struct {
+    Level  string `hcl:"level"`
+    Format string `hcl:"format"`
 }
 
 // ----------------------------------------
 // Read and parse HCL config file into Config
 func parseConfigFile(path string) (*Config, error) {
-    log.Printf("[INFO] loading config from %s", path)
+    logging.L().Info().Str("path", path).Msg("loading config")
     b, err := os.ReadFile(path)
     if err != nil {
         return nil, fmt.Errorf("read config: %w", err)
@@ -50,44 +168,181 @@ func validate(cfg *Config) error {
     if cfg.Listen == "" {
         // If not set, fall back to :9021 (intended for decision mode by default)
         cfg.Listen = ":9021"
-        log.Printf("[WARN] cfg.listen is empty -> defaulting to %s", cfg.Listen)
+        logging.L().Warn().Str("listen", cfg.Listen).Msg("cfg.listen is empty -> defaulting")
     }
     if cfg.WorkloadSocket == "" {
         cfg.WorkloadSocket = "unix:///run/spire/sockets/agent.sock"
-        log.Printf("[WARN] cfg.workload_socket empty -> defaulting to %s", cfg.WorkloadSocket)
+        logging.L().Warn().Str("workload_socket", cfg.WorkloadSocket).Msg("cfg.workload_socket empty -> defaulting")
     }
     if cfg.Mode == "" {
         cfg.Mode = "access_token_exchanger"
-        log.Printf("[WARN] cfg.mode empty -> defaulting to %s", cfg.Mode)
+        logging.L().Warn().Str("mode", cfg.Mode).Msg("cfg.mode empty -> defaulting")
+    }
+    if cfg.AdminListen == "" {
+        cfg.AdminListen = ":9090"
+        logging.L().Warn().Str("admin_listen", cfg.AdminListen).Msg("cfg.admin_listen empty -> defaulting")
+    }
+    if cfg.Log == nil {
+        cfg.Log = &LogConfig{}
+    }
+    if cfg.Log.Level == "" {
+        cfg.Log.Level = "info"
+    }
+    if cfg.Log.Format == "" {
+        cfg.Log.Format = "text"
+    }
+    if cfg.Cache == nil {
+        cfg.Cache = &CacheConfig{}
+    }
+    if cfg.Cache.MinTTL == "" {
+        cfg.Cache.MinTTL = "30s"
+    }
+    if cfg.Cache.Leeway == "" {
+        cfg.Cache.Leeway = "5s"
+    }
+    if _, err := time.ParseDuration(cfg.Cache.MinTTL); err != nil {
+        return fmt.Errorf("cache.min_ttl: %w", err)
+    }
+    if _, err := time.ParseDuration(cfg.Cache.Leeway); err != nil {
+        return fmt.Errorf("cache.leeway: %w", err)
+    }
+    if cfg.JWT == nil {
+        cfg.JWT = &JWTValidationConfig{}
+    }
+    if cfg.JWT.ClockSkew == "" {
+        cfg.JWT.ClockSkew = "1m"
     }
-    if cfg.SVIDAudienceForKeycloak == "" {
-        return fmt.Errorf("svid_audience_for_keycloak is required")
+    if cfg.JWT.MinRefreshInterval == "" {
+        cfg.JWT.MinRefreshInterval = "30s"
     }
-    if cfg.KeycloakTokenEndpoint == "" {
-        return fmt.Errorf("keycloak_token_endpoint is required")
+    if _, err := time.ParseDuration(cfg.JWT.ClockSkew); err != nil {
+        return fmt.Errorf("jwt.clock_skew: %w", err)
+    }
+    if _, err := time.ParseDuration(cfg.JWT.MinRefreshInterval); err != nil {
+        return fmt.Errorf("jwt.min_refresh_interval: %w", err)
+    }
+    if cfg.Mode == "access_token_validator_with_decision" && len(cfg.JWT.ExpectedIssuers) == 0 {
+        logging.L().Warn().Msg("jwt.expected_issuers is empty; trusting whatever issuer each provider's own OIDC discovery document reports")
+    }
+    if cfg.UMA == nil {
+        cfg.UMA = &UMAConfig{}
+    }
+    if cfg.Tracing == nil {
+        cfg.Tracing = &TracingConfig{}
+    }
+    if cfg.Tracing.ServiceName == "" {
+        cfg.Tracing.ServiceName = "envoy-jwt-auth-helper"
+    }
+    if cfg.Resilience == nil {
+        cfg.Resilience = &ResilienceConfig{}
+    }
+    if cfg.Resilience.BaseDelay != "" {
+        if _, err := time.ParseDuration(cfg.Resilience.BaseDelay); err != nil {
+            return fmt.Errorf("resilience.base_delay: %w", err)
+        }
+    }
+    if cfg.Resilience.Window != "" {
+        if _, err := time.ParseDuration(cfg.Resilience.Window); err != nil {
+            return fmt.Errorf("resilience.window: %w", err)
+        }
+    }
+    if cfg.Resilience.Cooldown != "" {
+        if _, err := time.ParseDuration(cfg.Resilience.Cooldown); err != nil {
+            return fmt.Errorf("resilience.cooldown: %w", err)
+        }
+    }
+    if len(cfg.Providers) == 0 {
+        // Legacy single-provider shorthand: synthesize a "default" provider
+        // from the flat top-level fields.
+        if cfg.SVIDAudienceForKeycloak == "" {
+            return fmt.Errorf("svid_audience_for_keycloak is required")
+        }
+        if cfg.KeycloakTokenEndpoint == "" {
+            return fmt.Errorf("keycloak_token_endpoint is required")
+        }
+        if cfg.Mode == "access_token_exchanger" && cfg.DownstreamAudience == "" {
+            return fmt.Errorf("downstream_audience is required in access_token_exchanger mode")
+        }
+        cfg.Providers = map[string]*ProviderConfig{
+            "default": {
+                DownstreamAudience:      cfg.DownstreamAudience,
+                SVIDAudienceForKeycloak: cfg.SVIDAudienceForKeycloak,
+                TokenEndpoint:           cfg.KeycloakTokenEndpoint,
+            },
+        }
+    } else {
+        for name, p := range cfg.Providers {
+            if p.SVIDAudienceForKeycloak == "" {
+                return fmt.Errorf("provider %q: svid_audience_for_keycloak is required", name)
+            }
+            if p.TokenEndpoint == "" && p.Issuer == "" && p.DiscoveryURL == "" {
+                return fmt.Errorf("provider %q: one of token_endpoint, issuer, or discovery_url is required", name)
+            }
+            if cfg.Mode == "access_token_exchanger" && p.DownstreamAudience == "" {
+                return fmt.Errorf("provider %q: downstream_audience is required in access_token_exchanger mode", name)
+            }
+        }
     }
-    if cfg.Mode == "access_token_exchanger" && cfg.DownstreamAudience == "" {
-        return fmt.Errorf("downstream_audience is required in access_token_exchanger mode")
+    if cfg.TLS != nil && !cfg.TLS.SPIFFE && (cfg.TLS.Cert == "" || cfg.TLS.Key == "") {
+        return fmt.Errorf("tls.cert and tls.key are required unless tls.spiffe is set")
     }
     return nil
 }
 
-// Minimal gRPC logging interceptor (handy to see ext_authz calls)
+// allowedSPIFFEIDs returns the configured peer allow-list, or nil when TLS
+// (and therefore peer identity) is not configured.
+func allowedSPIFFEIDs(tlsCfg *TLSConfig) []string {
+    if tlsCfg == nil {
+        return nil
+    }
+    return tlsCfg.AllowedSPIFFEIDs
+}
+
+// providerSpecs converts cfg.Providers into the myauth.ProviderSpec slice
+// expected by myauth.NewProviderRegistry/AuthServer.SetProviders.
+func providerSpecs(cfg *Config) []myauth.ProviderSpec {
+    specs := make([]myauth.ProviderSpec, 0, len(cfg.Providers))
+    for name, p := range cfg.Providers {
+        specs = append(specs, myauth.ProviderSpec{
+            Name:                    name,
+            Authority:               p.Authority,
+            DownstreamAudience:      p.DownstreamAudience,
+            SVIDAudienceForKeycloak: p.SVIDAudienceForKeycloak,
+            TokenEndpoint:           p.TokenEndpoint,
+            Issuer:                  p.Issuer,
+            DiscoveryURL:            p.DiscoveryURL,
+        })
+    }
+    return specs
+}
+
+// unaryLoggingInterceptor logs every ext_authz call with structured fields
+// (method, peer, spiffe_id, duration_ms, grpc_code) under a per-call
+// request_id, so a single invocation can be grepped end-to-end across this
+// interceptor and the token-exchange/UMA log lines it triggers downstream.
 func unaryLoggingInterceptor(
     ctx context.Context,
     req interface{},
     info *grpc.UnaryServerInfo,
     handler grpc.UnaryHandler,
 ) (interface{}, error) {
+    ctx, _ = logging.WithRequestID(ctx, "")
+    peerAddr, spiffeID := myauth.PeerInfo(ctx)
+
     start := time.Now()
-    log.Printf("[DEBUG] gRPC call start: method=%s", info.FullMethod)
     resp, err := handler(ctx, req)
     dur := time.Since(start)
+
+    ev := logging.WithContext(ctx).Info()
     if err != nil {
-        log.Printf("[ERROR] gRPC call error: method=%s err=%v dur=%s", info.FullMethod, err, dur)
-    } else {
-        log.Printf("[DEBUG] gRPC call ok: method=%s dur=%s", info.FullMethod, dur)
+        ev = logging.WithContext(ctx).Error().Err(err)
     }
+    ev.Str("method", info.FullMethod).
+        Str("peer", peerAddr).
+        Str("spiffe_id", spiffeID).
+        Dur("duration_ms", dur).
+        Str("grpc_code", status.Code(err).String()).
+        Msg("gRPC call")
     return resp, err
 }
 
@@ -96,98 +351,223 @@ func main() {
     configPath := flag.String("config", "/run/auth-helper/config/envoy-jwt-auth-helper.conf", "Path to the config file")
     flag.Parse()
 
-    log.Printf("[INFO] starting auth-helper pid=%d", os.Getpid())
-    log.Printf("[INFO] using configPath=%s", *configPath)
+    logging.L().Info().Int("pid", os.Getpid()).Str("config_path", *configPath).Msg("starting auth-helper")
 
     // 1) Load config and validate
     cfg, err := parseConfigFile(*configPath)
     if err != nil {
-        log.Fatalf("[ERROR] config parse failed: %v", err)
+        logging.L().Fatal().Err(err).Msg("config parse failed")
     }
     if err := validate(cfg); err != nil {
-        log.Fatalf("[ERROR] config validation failed: %v", err)
+        logging.L().Fatal().Err(err).Msg("config validation failed")
     }
-    log.Printf("[INFO] config: listen=%q mode=%q workload_socket=%q audience=%q keycloak=%q",
-        cfg.Listen, cfg.Mode, cfg.WorkloadSocket, cfg.DownstreamAudience, cfg.KeycloakTokenEndpoint)
+    logging.Configure(cfg.Log.Level, cfg.Log.Format)
+    // grpc-go's own logger is noisy at its default verbosity; only surface
+    // it when we're debugging, mirroring our own level.
+    if cfg.Log.Level != "debug" {
+        grpclog.SetLoggerV2(grpclog.NewLoggerV2(io.Discard, io.Discard, io.Discard))
+    }
+    logging.L().Info().
+        Str("listen", cfg.Listen).
+        Str("mode", cfg.Mode).
+        Str("workload_socket", cfg.WorkloadSocket).
+        Int("providers", len(cfg.Providers)).
+        Msg("config loaded")
+
+    shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+    if err != nil {
+        logging.L().Fatal().Err(err).Msg("tracing setup failed")
+    }
+    defer func() {
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := shutdownTracing(shutdownCtx); err != nil {
+            logging.L().Warn().Err(err).Msg("tracing shutdown error")
+        }
+    }()
 
     // 2) Start the gRPC server and bind the socket first (ensure the port is open early)
     lis, err := net.Listen("tcp", cfg.Listen)
     if err != nil {
-        log.Fatalf("[ERROR] listen(%s) failed: %v", cfg.Listen, err)
+        logging.L().Fatal().Err(err).Str("listen", cfg.Listen).Msg("listen failed")
+    }
+    logging.L().Info().Str("listen", cfg.Listen).Msg("tcp socket bound")
+
+    // mTLS: when cfg.tls is set, wrap the listener in TLS/mTLS (optionally
+    // SPIFFE-based) instead of serving plain TCP.
+    tlsCreds, closeTLS, err := buildServerTransportCredentials(context.Background(), cfg.TLS)
+    if err != nil {
+        logging.L().Fatal().Err(err).Msg("tls setup failed")
     }
-    log.Printf("[INFO] tcp socket bound on %s", cfg.Listen)
+    defer closeTLS()
 
-    grpcSrv := grpc.NewServer(
-        grpc.UnaryInterceptor(unaryLoggingInterceptor),
+    pai := myauth.NewPeerAuthzInterceptor(allowedSPIFFEIDs(cfg.TLS))
+    serverOpts := []grpc.ServerOption{
+        grpc.ChainUnaryInterceptor(
+            unaryLoggingInterceptor,
+            pai.Unary(),
+        ),
         grpc.MaxConcurrentStreams(10),
-    )
+    }
+    if tlsCreds != nil {
+        serverOpts = append(serverOpts, tlsCreds)
+        logging.L().Info().Bool("spiffe", cfg.TLS.SPIFFE).Msg("ext_authz listener using TLS")
+    } else {
+        logging.L().Warn().Msg("ext_authz listener using plain TCP; set tls { ... } to require mTLS")
+    }
+    grpcSrv := grpc.NewServer(serverOpts...)
+
+    providers, err := myauth.NewProviderRegistry(providerSpecs(cfg), &http.Client{Timeout: 30 * time.Second})
+    if err != nil {
+        logging.L().Fatal().Err(err).Msg("provider registry init failed")
+    }
+    discoveryCtx, cancelDiscovery := context.WithCancel(context.Background())
+    defer cancelDiscovery()
+    providers.StartDiscoveryRefresh(discoveryCtx, 10*time.Minute)
+
+    minTTL, _ := time.ParseDuration(cfg.Cache.MinTTL) // validated above
+    leeway, _ := time.ParseDuration(cfg.Cache.Leeway)  // validated above
+    cache := myauth.NewTokenCache(!cfg.Cache.Disabled, cfg.Cache.MaxEntries, minTTL, leeway, nil)
+
+    clockSkew, _ := time.ParseDuration(cfg.JWT.ClockSkew)          // validated above
+    minJWKSRefresh, _ := time.ParseDuration(cfg.JWT.MinRefreshInterval) // validated above
+    jwksCfg := myauth.JWKSConfig{
+        ExpectedIssuers:    cfg.JWT.ExpectedIssuers,
+        ExpectedAZPs:       cfg.JWT.ExpectedAZPs,
+        ClockSkew:          clockSkew,
+        MinRefreshInterval: minJWKSRefresh,
+    }
+
+    baseDelay, _ := time.ParseDuration(cfg.Resilience.BaseDelay) // validated above; "" parses as 0
+    window, _ := time.ParseDuration(cfg.Resilience.Window)       // validated above; "" parses as 0
+    cooldown, _ := time.ParseDuration(cfg.Resilience.Cooldown)   // validated above; "" parses as 0
+    resilienceCfg := myauth.ResilienceConfig{
+        Retry: myauth.RetryConfig{
+            MaxRetries: cfg.Resilience.MaxRetries,
+            BaseDelay:  baseDelay,
+        },
+        Breaker: myauth.BreakerConfig{
+            FailureThreshold: cfg.Resilience.FailureThreshold,
+            Window:           window,
+            Cooldown:         cooldown,
+        },
+    }
 
     // Design for late JWTSource injection (the myauth side exposes a setter)
     srv, err := myauth.NewAuthServer(
-        cfg.DownstreamAudience,
-        cfg.SVIDAudienceForKeycloak,
         cfg.Mode,
-        cfg.KeycloakTokenEndpoint,
+        providers,
+        cache,
+        jwksCfg,
+        resilienceCfg,
+        cfg.UMA.TicketChallenge,
         nil, // initially nil; will be supplied later if needed
     )
     if err != nil {
-        log.Fatalf("[ERROR] NewAuthServer error: %v", err)
+        logging.L().Fatal().Err(err).Msg("NewAuthServer error")
     }
     authpb.RegisterAuthorizationServer(grpcSrv, srv)
+    grpc_health_v1.RegisterHealthServer(grpcSrv, myauth.NewHealthServer(srv))
 
     errCh := make(chan error, 1)
     go func() {
-        log.Printf("[INFO] ext_authz gRPC server serving on %s (mode=%s)", cfg.Listen, cfg.Mode)
+        logging.L().Info().Str("listen", cfg.Listen).Str("mode", cfg.Mode).Msg("ext_authz gRPC server serving")
         errCh <- grpcSrv.Serve(lis)
     }()
 
-    // 3) Initialize JWTSource only when running in token exchange mode
+    // 2b) Start the admin HTTP server (liveness/readiness/metrics), separate
+    // from the ext_authz gRPC listener so it can be probed without mTLS.
+    adminMux := http.NewServeMux()
+    adminMux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        _, _ = w.Write([]byte("ok"))
+    })
+    adminMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+        if !srv.Ready() {
+            http.Error(w, "not ready", http.StatusServiceUnavailable)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        _, _ = w.Write([]byte("ok"))
+    })
+    adminMux.Handle("/metrics", promhttp.Handler())
+    adminSrv := &http.Server{Addr: cfg.AdminListen, Handler: adminMux}
+    go func() {
+        logging.L().Info().Str("admin_listen", cfg.AdminListen).Msg("admin HTTP server serving (/livez, /readyz, /metrics)")
+        if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            logging.L().Error().Err(err).Msg("admin HTTP server error")
+        }
+    }()
+
+    // 3) Initialize JWTSource when running in token exchange mode, or when
+    // the UMA ticket-challenge flow needs to authenticate as a federated
+    // client to fetch a permission ticket (see myauth.AuthServer.NeedsJWTSource)
     if srv.NeedsJWTSource() {
         go func() {
             for {
                 ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-                log.Printf("[INFO] initializing JWTSource addr=%s ...", cfg.WorkloadSocket)
+                logging.L().Info().Str("workload_socket", cfg.WorkloadSocket).Msg("initializing JWTSource")
                 js, err := workloadapi.NewJWTSource(ctx,
                     workloadapi.WithClientOptions(workloadapi.WithAddr(cfg.WorkloadSocket)))
                 cancel()
                 if err != nil {
-                    log.Printf("[WARN] JWTSource init failed: %v (retry in 5s)", err)
+                    logging.L().Warn().Err(err).Msg("JWTSource init failed, retrying in 5s")
+                    myauth.RecordJWTSourceRefreshError()
                     time.Sleep(5 * time.Second)
                     continue
                 }
-                log.Printf("[INFO] JWTSource ready")
+                logging.L().Info().Msg("JWTSource ready")
                 // Supply JWTSource via myauth.SetJWTSource(*workloadapi.JWTSource)
                 srv.SetJWTSource(js)
                 return
             }
         }()
     } else {
-        log.Printf("[INFO] JWTSource not required in mode=%s", srv.Mode())
+        logging.L().Info().Str("mode", srv.Mode().String()).Msg("JWTSource not required in this mode")
     }
 
-    // 4) Signal handling with graceful shutdown
+    // 4) Signal handling: SIGHUP (and config-file changes) trigger a
+    // hot-reload; SIGINT/SIGTERM trigger graceful shutdown.
     sigCh := make(chan os.Signal, 1)
     signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-    select {
-    case sig := <-sigCh:
-        log.Printf("[INFO] received signal: %s; shutting down...", sig)
-        done := make(chan struct{}, 1)
-        go func() {
-            grpcSrv.GracefulStop()
-            done <- struct{}{}
-        }()
+    reloadCh := make(chan string, 1)
+    watchReloadTriggers(*configPath, reloadCh)
+
+    for {
         select {
-        case <-done:
-            log.Printf("[INFO] grpc server stopped gracefully")
-        case <-time.After(5 * time.Second):
-            log.Printf("[WARN] graceful stop timed out; forcing stop")
-            grpcSrv.Stop()
-        }
-    case e := <-errCh:
-        // If Serve returned, log the cause
-        if e != nil && !errors.Is(e, grpc.ErrServerStopped) {
-            log.Printf("[ERROR] grpc serve error: %v", e)
+        case reason := <-reloadCh:
+            logging.L().Info().Str("reason", reason).Msg("reload triggered")
+            cfg = reloadConfig(*configPath, cfg, srv, pai)
+            logging.Configure(cfg.Log.Level, cfg.Log.Format)
+
+        case sig := <-sigCh:
+            logging.L().Info().Str("signal", sig.String()).Msg("received signal; shutting down")
+            done := make(chan struct{}, 1)
+            go func() {
+                grpcSrv.GracefulStop()
+                done <- struct{}{}
+            }()
+            select {
+            case <-done:
+                logging.L().Info().Msg("grpc server stopped gracefully")
+            case <-time.After(5 * time.Second):
+                logging.L().Warn().Msg("graceful stop timed out; forcing stop")
+                grpcSrv.Stop()
+            }
+            shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+            if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+                logging.L().Warn().Err(err).Msg("admin HTTP server shutdown error")
+            }
+            shutdownCancel()
+            return
+
+        case e := <-errCh:
+            // If Serve returned, log the cause
+            if e != nil && !errors.Is(e, grpc.ErrServerStopped) {
+                logging.L().Error().Err(e).Msg("grpc serve error")
+            }
+            return
         }
     }
-}
\ No newline at end of file
+}
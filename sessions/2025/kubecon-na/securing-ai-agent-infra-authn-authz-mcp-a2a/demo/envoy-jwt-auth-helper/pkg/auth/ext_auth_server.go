@@ -1,15 +1,17 @@
 package auth
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +20,11 @@ import (
 	authpb "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
 	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
@@ -61,12 +66,15 @@ func parseMode(s string) (Mode, error) {
 // ============================================================
 
 type Config struct {
-    jwtSource                *workloadapi.JWTSource
-    downstreamAudience       string
-    svidAudienceForKeycloak  string
-    keycloakTokenEndpoint    string
-    mode                     Mode
-    httpClient               *http.Client
+    jwtSource          *workloadapi.JWTSource
+    mode               Mode
+    httpClient         *http.Client
+    providers          *ProviderRegistry
+    cache              *TokenCache
+    verifier           *JWKSVerifier
+    umaTicketChallenge bool
+    retry              RetryConfig
+    breakers           *breakerRegistry
 }
 
 // AuthServer implements Envoy external authorization (ext_authz).
@@ -75,21 +83,54 @@ type AuthServer struct {
     config *Config
 }
 
-// NewAuthServer initializes the authorization server instance.
+// NewAuthServer initializes the authorization server instance. providers
+// selects the RFC 8693 / UMA target per request (see ProviderRegistry);
+// cache holds previously exchanged downstream tokens (see TokenCache);
+// jwksCfg configures the JWKS-backed signature verification used in
+// access_token_validator_with_decision mode (see JWKSVerifier).
+// resilienceCfg bounds the retry-with-backoff and circuit-breaking wrapped
+// around every outbound Keycloak call (see doPost); a zero field in either
+// of its halves defaults the same way JWKSConfig's MinRefreshInterval does.
+// umaTicketChallenge enables the UMA permission-ticket challenge flow (see
+// buildUMAChallenge) for decisions Keycloak denies in that mode; it also
+// makes NeedsJWTSource report true, since fetching a ticket authenticates
+// as a federated client the same way token exchange does.
 func NewAuthServer(
-    downstreamAudience string,
-    svidAudienceForKeycloak string,
     modeStr string,
-    keycloakTokenEndpoint string,
+    providers *ProviderRegistry,
+    cache *TokenCache,
+    jwksCfg JWKSConfig,
+    resilienceCfg ResilienceConfig,
+    umaTicketChallenge bool,
     jwtSource *workloadapi.JWTSource,
 ) (*AuthServer, error) {
+    if resilienceCfg.Retry.MaxRetries <= 0 {
+        resilienceCfg.Retry.MaxRetries = 2
+    }
+    if resilienceCfg.Retry.BaseDelay <= 0 {
+        resilienceCfg.Retry.BaseDelay = 200 * time.Millisecond
+    }
+    if resilienceCfg.Breaker.FailureThreshold <= 0 {
+        resilienceCfg.Breaker.FailureThreshold = 5
+    }
+    if resilienceCfg.Breaker.Window <= 0 {
+        resilienceCfg.Breaker.Window = 30 * time.Second
+    }
+    if resilienceCfg.Breaker.Cooldown <= 0 {
+        resilienceCfg.Breaker.Cooldown = 30 * time.Second
+    }
+
+    httpClient := &http.Client{Timeout: 30 * time.Second}
     cfg := &Config{
-        jwtSource:               jwtSource, // may be nil; can be injected later
-        downstreamAudience:      downstreamAudience,
-        svidAudienceForKeycloak: svidAudienceForKeycloak,
-        keycloakTokenEndpoint:   keycloakTokenEndpoint,
-        mode:                    AccessTokenExchanger,
-        httpClient:              &http.Client{Timeout: 30 * time.Second},
+        jwtSource:          jwtSource, // may be nil; can be injected later
+        mode:               AccessTokenExchanger,
+        httpClient:         httpClient,
+        providers:          providers,
+        cache:              cache,
+        verifier:           NewJWKSVerifier(httpClient, jwksCfg),
+        umaTicketChallenge: umaTicketChallenge,
+        retry:              resilienceCfg.Retry,
+        breakers:           newBreakerRegistry(resilienceCfg.Breaker),
     }
     if modeStr != "" {
         m, err := parseMode(modeStr)
@@ -98,7 +139,7 @@ func NewAuthServer(
         }
         cfg.mode = m
     }
-    log.Printf("[INFO] AuthServer initialized (mode=%s)", cfg.mode)
+    logging.L().Info().Str("mode", cfg.mode.String()).Bool("uma_ticket_challenge", cfg.umaTicketChallenge).Msg("AuthServer initialized")
     return &AuthServer{config: cfg}, nil
 }
 
@@ -107,9 +148,12 @@ func (a *AuthServer) Mode() Mode {
     return a.config.mode
 }
 
-// NeedsJWTSource returns true only when RFC 8693 Token Exchange is enabled.
+// NeedsJWTSource returns true when RFC 8693 Token Exchange is enabled, or
+// when the UMA ticket-challenge flow is enabled - fetching a permission
+// ticket authenticates to the provider as a federated client the same way
+// token exchange does (see requestPermissionTicket).
 func (a *AuthServer) NeedsJWTSource() bool {
-    return a.config.mode == AccessTokenExchanger
+    return a.config.mode == AccessTokenExchanger || a.config.umaTicketChallenge
 }
 
 // SetJWTSource allows late injection of JWTSource after server start.
@@ -117,7 +161,13 @@ func (a *AuthServer) SetJWTSource(js *workloadapi.JWTSource) {
     a.mu.Lock()
     defer a.mu.Unlock()
     a.config.jwtSource = js
-    log.Printf("[INFO] JWTSource set on AuthServer")
+    logging.L().Info().Msg("JWTSource set on AuthServer")
+}
+
+// SetProviders atomically replaces the provider registry's contents, e.g.
+// after a config hot-reload. Safe to call concurrently with Check.
+func (a *AuthServer) SetProviders(specs []ProviderSpec) {
+    a.config.providers.Replace(specs)
 }
 
 // ============================================================
@@ -153,6 +203,25 @@ func buildResourceMetadataURLStrict(req *authpb.CheckRequest) string {
     return scheme + "://" + host + "/.well-known/oauth-protected-resource"
 }
 
+// requestAuthority extracts the caller's :authority (H2) or Host (H1)
+// header, used to select a provider from the registry. Returns "" if
+// neither is present; ProviderRegistry.Select still falls back to its
+// default provider in that case.
+func requestAuthority(req *authpb.CheckRequest) string {
+    headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+    for k, v := range headers {
+        if strings.EqualFold(k, ":authority") {
+            return v
+        }
+    }
+    for k, v := range headers {
+        if strings.EqualFold(k, "host") {
+            return v
+        }
+    }
+    return ""
+}
+
 // ============================================================
 // Check entrypoint
 // ============================================================
@@ -162,6 +231,15 @@ func (a *AuthServer) Check(ctx context.Context, req *authpb.CheckRequest) (*auth
     path := req.Attributes.GetRequest().GetHttp().GetPath()
     method := strings.ToLower(req.Attributes.GetRequest().GetHttp().GetMethod())
 
+    // Pick up the caller's traceparent (if any), so this Check's span is a
+    // child of the upstream request's trace rather than a new root.
+    ctx = extractTraceContext(ctx, req.Attributes.GetRequest().GetHttp().GetHeaders())
+    ctx, span := tracer.Start(ctx, "AuthServer.Check", trace.WithAttributes(
+        attribute.String("authz.mode", a.config.mode.String()),
+        attribute.String("http.route", path),
+    ))
+    defer span.End()
+
     // Verify Authorization header presence and extract bearer token
     authHeader := req.Attributes.Request.Http.Headers["authorization"]
     token, ok := parseBearerToken(authHeader)
@@ -169,26 +247,46 @@ func (a *AuthServer) Check(ctx context.Context, req *authpb.CheckRequest) (*auth
         // Build an MCP-compliant challenge strictly from headers, if possible
         mcpMeta := buildResourceMetadataURLStrict(req)
         if mcpMeta == "" {
-            log.Printf("[WARN] missing/malformed Authorization AND insufficient headers to build resource_metadata (need X-Forwarded-Proto + :authority/host)")
+            logging.WithContext(ctx).Warn().Msg("missing/malformed Authorization AND insufficient headers to build resource_metadata (need X-Forwarded-Proto + :authority/host)")
             // Return 401 without challenge when we cannot construct resource_metadata
+            recordCheckOutcome(span, a.config.mode, "deny", "missing_authorization")
             return a.unauthorizedResponseWithoutChallenge("invalid or missing authorization header"), nil
         }
-        log.Printf("[WARN] missing/malformed Authorization; resource_metadata=%s", mcpMeta)
+        logging.WithContext(ctx).Warn().Str("resource_metadata", mcpMeta).Msg("missing/malformed Authorization")
+        recordCheckOutcome(span, a.config.mode, "deny", "missing_authorization")
         return a.unauthorizedResponseWithMCP(mcpMeta, "invalid or missing authorization header"), nil
     }
 
+    provider, err := a.config.providers.Select(requestAuthority(req))
+    if err != nil {
+        logging.WithContext(ctx).Warn().Err(err).Msg("no provider matched for request")
+        recordCheckOutcome(span, a.config.mode, "deny", "no_provider")
+        return a.forbiddenResponse("no token-exchange provider configured for this request"), nil
+    }
+
     switch a.config.mode {
     case AccessTokenExchanger:
         // RFC 8693 Token Exchange
-        exchanged, err := a.exchangeAccessToken(ctx, token)
+        exchanged, err := a.exchangeAccessToken(ctx, token, provider)
         if err != nil {
             if errors.Is(err, ErrJWTSourceNotReady) {
                 // Missing JWT-SVID source is a server-side transient failure -> return 503 without challenge
-                log.Printf("[WARN] token exchange aborted: jwt-source-not-ready -> 503")
+                logging.WithContext(ctx).Warn().Msg("token exchange aborted: jwt-source-not-ready -> 503")
+                recordCheckOutcome(span, a.config.mode, "unavailable", "jwt_source_not_ready")
                 return a.serviceUnavailableResponse("jwt-source-not-ready", /*retryAfterSeconds*/ 30), nil
             }
-            log.Printf("[ERROR] token exchange failed: %v", err)
+            var cbErr *CircuitOpenError
+            if errors.As(err, &cbErr) {
+                // Keycloak's token endpoint looks unavailable, not that the
+                // caller lacks permission -> 503 with Retry-After, same as
+                // ErrJWTSourceNotReady.
+                logging.WithContext(ctx).Warn().Err(cbErr).Msg("token exchange aborted: circuit open -> 503")
+                recordCheckOutcome(span, a.config.mode, "unavailable", "circuit_open")
+                return a.serviceUnavailableResponse("keycloak temporarily unavailable", int(cbErr.RetryAfter.Seconds())), nil
+            }
+            logging.WithContext(ctx).Error().Err(err).Msg("token exchange failed")
             // Other exchange failures -> return 403
+            recordCheckOutcome(span, a.config.mode, "deny", "token_exchange_failed")
             return a.forbiddenResponse(err.Error()), nil
         }
         // Rewrite Authorization header with the downstream token
@@ -199,33 +297,81 @@ func (a *AuthServer) Check(ctx context.Context, req *authpb.CheckRequest) (*auth
                 Value: fmt.Sprintf("Bearer %s", exchanged),
             },
         }}
-        log.Printf("[DEBUG] token exchange succeeded; header rewritten")
+        logging.WithContext(ctx).Debug().Msg("token exchange succeeded; header rewritten")
+        recordCheckOutcome(span, a.config.mode, "allow", "token_exchanged")
         return a.okResponse(headers), nil
 
     case AccessTokenValidatorWithDecision:
-        // (1) Perform a local audience-only check (no signature verification)
-        audOK, err := checkAudienceOnly(token, a.config.svidAudienceForKeycloak)
-        if err != nil || !audOK {
-            log.Printf("[WARN] audience check failed: audOK=%v err=%v", audOK, err)
-            // Audience mismatch is unlikely to be fixed by re-authentication -> 403
-            return a.forbiddenResponse("audience check failed"), nil
+        // (1) Full RS256/ES256 signature verification via OIDC discovery +
+        // JWKS, plus iss/aud/exp/nbf/azp checks (see JWKSVerifier). A
+        // verification failure may just mean the token expired or the
+        // signing key rotated, and the client can retry with a fresh token
+        // -> 401 with the MCP challenge, not 403.
+        claims, verr := a.config.verifier.checkAccessTokenWithJWKS(ctx, token, provider)
+        if verr != nil {
+            logging.WithContext(ctx).Warn().Err(verr).Msg("access token verification failed")
+            recordCheckOutcome(span, a.config.mode, "deny", "jwt_verification_failed")
+            mcpMeta := buildResourceMetadataURLStrict(req)
+            if mcpMeta == "" {
+                return a.unauthorizedResponseWithoutChallenge("access token verification failed"), nil
+            }
+            return a.unauthorizedResponseWithMCP(mcpMeta, "access token verification failed"), nil
         }
-        // (2) Delegate authorization decision to Keycloak UMA
-        decision, derr := a.delegateDecision(ctx, token, path, method)
+
+        // (2) If token is itself a UMA RPT (i.e. it carries an
+        // authorization.permissions claim, set by Keycloak when a client
+        // exchanged a permission ticket for one - see buildUMAChallenge),
+        // the decision was already made by Keycloak at ticket-exchange
+        // time; verify it locally instead of re-calling delegateDecision.
+        if allowed, isRPT := verifyRPT(claims, path, method); isRPT {
+            if allowed {
+                logging.WithContext(ctx).Debug().Msg("decision=ALLOW (RPT)")
+                recordCheckOutcome(span, a.config.mode, "allow", "rpt")
+                return a.okResponse(nil), nil
+            }
+            logging.WithContext(ctx).Debug().Msg("decision=DENY (RPT)")
+            recordCheckOutcome(span, a.config.mode, "deny", "rpt")
+            return a.forbiddenResponse("PERMISSION_DENIED"), nil
+        }
+
+        // (3) Not an RPT: delegate the authorization decision to Keycloak
+        // UMA (response_mode=decision).
+        decision, derr := a.delegateDecision(ctx, token, path, method, provider)
         if derr != nil {
-            log.Printf("[ERROR] UMA decision delegation failed: %v", derr)
+            var cbErr *CircuitOpenError
+            if errors.As(derr, &cbErr) {
+                // Keycloak's decision endpoint looks unavailable, not that
+                // the caller lacks permission -> 503 with Retry-After.
+                logging.WithContext(ctx).Warn().Err(cbErr).Msg("UMA decision delegation aborted: circuit open -> 503")
+                recordCheckOutcome(span, a.config.mode, "unavailable", "circuit_open")
+                return a.serviceUnavailableResponse("keycloak temporarily unavailable", int(cbErr.RetryAfter.Seconds())), nil
+            }
+            logging.WithContext(ctx).Error().Err(derr).Msg("UMA decision delegation failed")
+            recordCheckOutcome(span, a.config.mode, "deny", "decision_delegation_failed")
             return a.forbiddenResponse(derr.Error()), nil
         }
         if decision {
-            log.Printf("[DEBUG] decision=ALLOW")
+            logging.WithContext(ctx).Debug().Msg("decision=ALLOW")
+            recordCheckOutcome(span, a.config.mode, "allow", "uma_decision")
             return a.okResponse(nil), nil
         }
-        log.Printf("[DEBUG] decision=DENY")
+        logging.WithContext(ctx).Debug().Msg("decision=DENY")
+        if a.config.umaTicketChallenge {
+            challengeResp, cerr := a.buildUMAChallenge(ctx, path, method, provider)
+            if cerr != nil {
+                logging.WithContext(ctx).Error().Err(cerr).Msg("UMA permission-ticket challenge failed; falling back to plain 403")
+                recordCheckOutcome(span, a.config.mode, "deny", "uma_decision")
+                return a.forbiddenResponse("PERMISSION_DENIED"), nil
+            }
+            recordCheckOutcome(span, a.config.mode, "deny", "uma_ticket_challenge")
+            return challengeResp, nil
+        }
+        recordCheckOutcome(span, a.config.mode, "deny", "uma_decision")
         return a.forbiddenResponse("PERMISSION_DENIED"), nil
 
     default:
         err := fmt.Errorf("unknown server mode: %s", a.config.mode)
-        log.Printf("[ERROR] %v", err)
+        logging.WithContext(ctx).Error().Err(err).Msg("Check: unsupported mode")
         return nil, err
     }
 }
@@ -236,19 +382,84 @@ func (a *AuthServer) Check(ctx context.Context, req *authpb.CheckRequest) (*auth
 
 var ErrJWTSourceNotReady = errors.New("jwt-source-not-ready")
 
-func (a *AuthServer) exchangeAccessToken(ctx context.Context, subjectToken string) (string, error) {
+// exchangeCacheKey derives the TokenCache key for subjectToken exchanged
+// against provider: a stable SHA-256 hash of the subject token plus the
+// provider's downstream audience and Keycloak client id, so (a) the same
+// incoming token exchanged for two different audiences/providers gets two
+// cache entries, and (b) every subject token is cacheable - the previous
+// key (the subject token's jti claim) silently disabled caching for any
+// token that happened not to carry one.
+func exchangeCacheKey(subjectToken string, provider *Provider) string {
+    h := sha256.New()
+    io.WriteString(h, subjectToken)
+    h.Write([]byte{0})
+    io.WriteString(h, provider.spec.DownstreamAudience)
+    h.Write([]byte{0})
+    io.WriteString(h, provider.spec.SVIDAudienceForKeycloak)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// exchangeAccessToken returns a downstream-audience token for subjectToken,
+// serving from a.config.cache when a fresh entry exists for this
+// subject-token+provider pair, and otherwise performing the RFC 8693
+// exchange against provider (coalescing concurrent identical requests via
+// the cache's singleflight.Group, since Envoy issues ext_authz once per
+// HTTP request and bursts of identical calls are common under load).
+// Cache hit/miss counts are recorded by TokenCache.get itself (see
+// CacheMetrics), including when the cache is disabled.
+func (a *AuthServer) exchangeAccessToken(ctx context.Context, subjectToken string, provider *Provider) (string, error) {
+    cacheKey := exchangeCacheKey(subjectToken, provider)
+    if token, ok := a.config.cache.get(cacheKey); ok {
+        return token, nil
+    }
+
+    v, err, _ := a.config.cache.group.Do(cacheKey, func() (interface{}, error) {
+        return a.doExchangeAccessToken(ctx, subjectToken, provider)
+    })
+    if err != nil {
+        return "", err
+    }
+    result := v.(exchangeResult)
+
+    if result.cacheTTL > 0 {
+        a.config.cache.set(cacheKey, result.token, time.Now().Add(result.cacheTTL))
+    }
+    return result.token, nil
+}
+
+// exchangeResult is what a.doExchangeAccessToken hands back to both the
+// caller of exchangeAccessToken and, via singleflight, every request that
+// was coalesced into the same upstream call.
+type exchangeResult struct {
+    token string
+    // cacheTTL is how long the token may be served from cache: the
+    // upstream's expires_in minus the configured leeway, or 0 if it isn't
+    // long enough to be worth caching (below cache.min_ttl).
+    cacheTTL time.Duration
+}
+
+// doExchangeAccessToken performs one RFC 8693 token-exchange call to
+// provider's token endpoint, authenticating as a federated client with a
+// JWT-SVID, via doPost - so it gets the same retry-with-backoff and
+// circuit-breaking as every other outbound Keycloak call this package
+// makes. It never reads or writes a.config.cache; callers handle caching
+// and request coalescing.
+func (a *AuthServer) doExchangeAccessToken(ctx context.Context, subjectToken string, provider *Provider) (exchangeResult, error) {
     // Ensure JWTSource is provided; otherwise return 503-equivalent error
     a.mu.RLock()
     js := a.config.jwtSource
     a.mu.RUnlock()
     if js == nil {
-        return "", ErrJWTSourceNotReady
+        recordTokenExchangeError("jwt_source_not_ready")
+        return exchangeResult{}, ErrJWTSourceNotReady
     }
 
-    realmBase, err := extractRealmBase(a.config.keycloakTokenEndpoint)
+    tokenEndpoint := provider.TokenEndpoint()
+    realmBase, err := extractRealmBase(tokenEndpoint)
     if err != nil {
-        log.Printf("[ERROR] extractRealmBase failed: %v", err)
-        return "", err
+        logging.WithContext(ctx).Error().Err(err).Msg("extractRealmBase failed")
+        recordTokenExchangeError("bad_token_endpoint")
+        return exchangeResult{}, err
     }
 
     // Obtain a JWT-SVID to authenticate as a federated client to Keycloak
@@ -256,7 +467,8 @@ func (a *AuthServer) exchangeAccessToken(ctx context.Context, subjectToken strin
         Audience: realmBase,
     })
     if err != nil {
-        return "", fmt.Errorf("fetch jwt-svid failed: %w", err)
+        recordTokenExchangeError("jwt_svid_fetch_failed")
+        return exchangeResult{}, fmt.Errorf("fetch jwt-svid failed: %w", err)
     }
     svidJWT := svid.Marshal()
 
@@ -267,105 +479,307 @@ func (a *AuthServer) exchangeAccessToken(ctx context.Context, subjectToken strin
     form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
     form.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
     // downstreamAudience -> audience for the downstream service
-    form.Set("scope", a.config.downstreamAudience)
+    form.Set("scope", provider.spec.DownstreamAudience)
 
     // --- Federated JWT client authentication (SPIFFE draft) ---
     // client_id uses the last SPIFFE segment (e.g., "frontend"), not the full SPIFFE ID
-    form.Set("client_id", a.config.svidAudienceForKeycloak)
+    form.Set("client_id", provider.spec.SVIDAudienceForKeycloak)
     form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe")
     form.Set("client_assertion", svidJWT) // send the JWT-SVID as client assertion as-is
 
-    req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.keycloakTokenEndpoint, strings.NewReader(form.Encode()))
-    if err != nil {
-        return "", err
-    }
-    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-    // Request log (sensitive values masked)
-    logHTTPRequest("token-exchange", req.Method, req.URL.String(), req.Header, form)
-
-    // Send & measure
     start := time.Now()
-    resp, err := a.config.httpClient.Do(req)
+    status, resBodyRaw, err := a.doPost(ctx, "token-exchange", tokenEndpoint, "", form, nil)
     elapsed := time.Since(start)
     if err != nil {
-        return "", err
+        recordTokenExchangeLatency("error", elapsed.Seconds())
+        var cbErr *CircuitOpenError
+        if errors.As(err, &cbErr) {
+            recordTokenExchangeError("circuit_open")
+        } else {
+            recordTokenExchangeError("keycloak_unreachable")
+        }
+        return exchangeResult{}, err
     }
-    defer resp.Body.Close()
 
-    // Response log (sensitive values masked)
-    resBodyRaw, _ := io.ReadAll(resp.Body)
-    redacted := redactJSONBody(resBodyRaw)
-    logHTTPResponse("token-exchange", resp.StatusCode, resp.Header, redacted, elapsed)
-
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("token-exchange response %d: %s", resp.StatusCode, string(resBodyRaw))
+    if status != http.StatusOK {
+        recordTokenExchangeLatency("error", elapsed.Seconds())
+        recordTokenExchangeError("keycloak_" + strconv.Itoa(status))
+        return exchangeResult{}, fmt.Errorf("token-exchange response %d: %s", status, string(resBodyRaw))
     }
+    recordTokenExchangeLatency("ok", elapsed.Seconds())
 
     var body struct {
         AccessToken string `json:"access_token"`
         TokenType   string `json:"token_type"`
         ExpiresIn   int64  `json:"expires_in"`
     }
-    if err := json.Unmarshal(resBodyRaw, &body); err != nil {
-        return "", err
+    if jErr := json.Unmarshal(resBodyRaw, &body); jErr != nil {
+        recordTokenExchangeError("bad_response_body")
+        return exchangeResult{}, jErr
     }
     if body.AccessToken == "" {
-        return "", fmt.Errorf("empty access_token in token-exchange response")
+        recordTokenExchangeError("empty_access_token")
+        return exchangeResult{}, fmt.Errorf("empty access_token in token-exchange response")
     }
-    return body.AccessToken, nil
+
+    ttl := time.Duration(body.ExpiresIn)*time.Second - a.config.cache.cfg.leeway
+    if ttl < a.config.cache.cfg.minTTL {
+        ttl = 0
+    }
+    return exchangeResult{token: body.AccessToken, cacheTTL: ttl}, nil
 }
 
 // ============================================================
-// UMA decision delegation (Keycloak)
+// UMA decision delegation and permission-ticket challenge (Keycloak)
 // ============================================================
 
-func (a *AuthServer) delegateDecision(ctx context.Context, userAccessToken string, resourcePath string, method string) (bool, error) {
-    form := url.Values{}
-    form.Set("grant_type", "urn:ietf:params:oauth:grant-type:uma-ticket")
-    // audience -> Keycloak resource server (client_id)
-    form.Set("audience", a.config.svidAudienceForKeycloak)
-    form.Set("response_mode", "decision")
+// doPost sends a POST request to endpoint, retrying network errors and 5xx
+// responses with exponential backoff + jitter (up to a.config.retry) and
+// guarded by a per-endpoint circuit breaker (see breakerRegistry): once
+// that breaker is open, doPost returns a *CircuitOpenError immediately
+// instead of attempting (and presumably failing) the request. Every
+// attempt's request and response are logged (sensitive values masked) via
+// doPostOnce, the same way for every Keycloak call this package makes.
+// Exactly one of form or jsonBody should be set - see doPostOnce.
+func (a *AuthServer) doPost(ctx context.Context, tag string, endpoint string, bearerToken string, form url.Values, jsonBody []byte) (status int, respBody []byte, err error) {
+    breaker := a.config.breakers.get(endpoint)
+    if allowed, retryAfter := breaker.allow(); !allowed {
+        return 0, nil, &CircuitOpenError{Endpoint: endpoint, RetryAfter: retryAfter}
+    }
+
+    for attempt := 0; ; attempt++ {
+        status, respBody, err = a.doPostOnce(ctx, tag, endpoint, bearerToken, form, jsonBody)
+        if err == nil && !isRetryableStatus(status) {
+            break
+        }
+        if attempt >= a.config.retry.MaxRetries {
+            break
+        }
+        delay := backoffWithJitter(a.config.retry.BaseDelay, attempt)
+        logging.WithContext(ctx).Warn().Str("tag", tag).Str("endpoint", endpoint).Int("attempt", attempt+1).Dur("delay", delay).Msg("retrying Keycloak call")
+        select {
+        case <-ctx.Done():
+            breaker.recordResult(false)
+            return status, respBody, ctx.Err()
+        case <-time.After(delay):
+        }
+    }
+    breaker.recordResult(err == nil && !isRetryableStatus(status))
+    return status, respBody, err
+}
 
-    scope := method
-    perm := fmt.Sprintf("%s#%s", resourcePath, scope)
-    form.Add("permission", perm)
+// doPostOnce sends a single POST request to endpoint, logging the request
+// and response (sensitive values masked) the same way for every Keycloak
+// call this package makes. Exactly one of form or jsonBody should be set:
+// form is sent as application/x-www-form-urlencoded (used by the token
+// endpoint and decision delegation), jsonBody as application/json (used by
+// the UMA protection API). bearerToken, if non-empty, is sent as an
+// Authorization header. Called only from doPost, which wraps it in
+// retry-with-backoff and circuit breaking.
+func (a *AuthServer) doPostOnce(ctx context.Context, tag string, endpoint string, bearerToken string, form url.Values, jsonBody []byte) (status int, respBody []byte, err error) {
+    ctx, span := startKeycloakSpan(ctx, tag)
+    callStart := time.Now()
+    defer func() { endKeycloakSpan(span, tag, status, time.Since(callStart), err) }()
+
+    var reqBody io.Reader
+    contentType := "application/json"
+    if form != nil {
+        reqBody = strings.NewReader(form.Encode())
+        contentType = "application/x-www-form-urlencoded"
+    } else {
+        reqBody = bytes.NewReader(jsonBody)
+    }
 
-    req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.keycloakTokenEndpoint, strings.NewReader(form.Encode()))
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, reqBody)
     if err != nil {
-        return false, err
+        return 0, nil, err
+    }
+    req.Header.Set("Content-Type", contentType)
+    if bearerToken != "" {
+        req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", bearerToken)) // masked in logs
     }
-    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-    req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", userAccessToken)) // masked in logs
 
     // Request log (sensitive values masked)
-    logHTTPRequest("uma-decision", req.Method, req.URL.String(), req.Header, form)
+    logHTTPRequest(ctx, tag, req.Method, req.URL.String(), req.Header, form)
 
     start := time.Now()
     resp, err := a.config.httpClient.Do(req)
     elapsed := time.Since(start)
     if err != nil {
-        return false, err
+        return 0, nil, err
     }
     defer resp.Body.Close()
 
     // Response log (sensitive values masked)
     resBodyRaw, _ := io.ReadAll(resp.Body)
-    redacted := redactJSONBody(resBodyRaw)
-    logHTTPResponse("uma-decision", resp.StatusCode, resp.Header, redacted, elapsed)
+    logHTTPResponse(ctx, tag, resp.StatusCode, resp.Header, redactJSONBody(resBodyRaw), elapsed)
+    return resp.StatusCode, resBodyRaw, nil
+}
+
+// delegateDecision asks Keycloak (response_mode=decision) whether
+// userAccessToken's holder may perform method on resourcePath, evaluated as
+// that user - i.e. without first obtaining a permission ticket. A false
+// result means access is denied for now, not necessarily forever: see
+// buildUMAChallenge for the stepped-up flow that lets a client retry with
+// an RPT instead.
+func (a *AuthServer) delegateDecision(ctx context.Context, userAccessToken string, resourcePath string, method string, provider *Provider) (bool, error) {
+    form := url.Values{}
+    form.Set("grant_type", "urn:ietf:params:oauth:grant-type:uma-ticket")
+    // audience -> Keycloak resource server (client_id)
+    form.Set("audience", provider.spec.SVIDAudienceForKeycloak)
+    form.Set("response_mode", "decision")
+    form.Add("permission", fmt.Sprintf("%s#%s", resourcePath, method))
 
-    if resp.StatusCode != http.StatusOK {
-        return false, fmt.Errorf("decision response %d: %s", resp.StatusCode, string(resBodyRaw))
+    status, respBody, err := a.doPost(ctx, "uma-decision", provider.TokenEndpoint(), userAccessToken, form, nil)
+    if err != nil {
+        return false, err
+    }
+    if status != http.StatusOK {
+        return false, fmt.Errorf("decision response %d: %s", status, string(respBody))
     }
     var body struct {
         Result bool `json:"result"`
     }
-    if err := json.Unmarshal(resBodyRaw, &body); err != nil {
+    if err := json.Unmarshal(respBody, &body); err != nil {
         return false, err
     }
     return body.Result, nil
 }
 
+// fetchProtectionAPIToken obtains a Protection API Token (PAT) for provider
+// by authenticating as a federated client with a JWT-SVID - the same
+// client_assertion mechanism doExchangeAccessToken uses for RFC 8693
+// exchange - via an OAuth2 client_credentials grant. The PAT authorizes
+// calls to provider's UMA protection API (see requestPermissionTicket).
+func (a *AuthServer) fetchProtectionAPIToken(ctx context.Context, provider *Provider) (string, error) {
+    a.mu.RLock()
+    js := a.config.jwtSource
+    a.mu.RUnlock()
+    if js == nil {
+        return "", ErrJWTSourceNotReady
+    }
+
+    tokenEndpoint := provider.TokenEndpoint()
+    realmBase, err := extractRealmBase(tokenEndpoint)
+    if err != nil {
+        return "", err
+    }
+    svid, err := js.FetchJWTSVID(ctx, jwtsvid.Params{Audience: realmBase})
+    if err != nil {
+        return "", fmt.Errorf("fetch jwt-svid failed: %w", err)
+    }
+
+    form := url.Values{}
+    form.Set("grant_type", "client_credentials")
+    form.Set("client_id", provider.spec.SVIDAudienceForKeycloak)
+    form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe")
+    form.Set("client_assertion", svid.Marshal())
+
+    status, respBody, err := a.doPost(ctx, "uma-pat", tokenEndpoint, "", form, nil)
+    if err != nil {
+        return "", err
+    }
+    if status != http.StatusOK {
+        return "", fmt.Errorf("protection-api token response %d: %s", status, string(respBody))
+    }
+    var body struct {
+        AccessToken string `json:"access_token"`
+    }
+    if err := json.Unmarshal(respBody, &body); err != nil {
+        return "", err
+    }
+    if body.AccessToken == "" {
+        return "", fmt.Errorf("empty access_token in protection-api token response")
+    }
+    return body.AccessToken, nil
+}
+
+// requestPermissionTicket asks provider's UMA protection API
+// (<realm-base>/authz/protection/permission) for a permission ticket
+// scoping resourcePath+method, authenticating with a freshly-fetched PAT
+// (see fetchProtectionAPIToken). The returned ticket is handed to the
+// caller as a WWW-Authenticate: UMA challenge (see buildUMAChallenge); the
+// client then posts it to the token endpoint
+// (grant_type=urn:ietf:params:oauth:grant-type:uma-ticket) to obtain an
+// RPT, which Check verifies locally thereafter (see verifyRPT).
+func (a *AuthServer) requestPermissionTicket(ctx context.Context, resourcePath string, method string, provider *Provider) (string, error) {
+    pat, err := a.fetchProtectionAPIToken(ctx, provider)
+    if err != nil {
+        return "", fmt.Errorf("fetch protection api token: %w", err)
+    }
+
+    realmBase, err := extractRealmBase(provider.TokenEndpoint())
+    if err != nil {
+        return "", err
+    }
+    reqBody, err := json.Marshal([]map[string]interface{}{{
+        "resource_id":     resourcePath,
+        "resource_scopes": []string{method},
+    }})
+    if err != nil {
+        return "", err
+    }
+
+    status, respBody, err := a.doPost(ctx, "uma-ticket", realmBase+"/authz/protection/permission", pat, nil, reqBody)
+    if err != nil {
+        return "", err
+    }
+    if status != http.StatusCreated && status != http.StatusOK {
+        return "", fmt.Errorf("permission ticket response %d: %s", status, string(respBody))
+    }
+    var body struct {
+        Ticket string `json:"ticket"`
+    }
+    if err := json.Unmarshal(respBody, &body); err != nil {
+        return "", err
+    }
+    if body.Ticket == "" {
+        return "", fmt.Errorf("empty ticket in permission ticket response")
+    }
+    return body.Ticket, nil
+}
+
+// buildUMAChallenge fetches a UMA permission ticket for resourcePath+method
+// (see requestPermissionTicket) and returns a 401 response carrying a UMA
+// 2.0 WWW-Authenticate challenge
+// (`UMA realm="...", as_uri="...", ticket="..."`) per Keycloak's UMA grant.
+// A client that understands UMA exchanges the ticket for an RPT at
+// provider's token endpoint and retries with it.
+func (a *AuthServer) buildUMAChallenge(ctx context.Context, resourcePath string, method string, provider *Provider) (*authpb.CheckResponse, error) {
+    ticket, err := a.requestPermissionTicket(ctx, resourcePath, method, provider)
+    if err != nil {
+        return nil, err
+    }
+    issuer := provider.Issuer()
+    if issuer == "" {
+        realmBase, rerr := extractRealmBase(provider.TokenEndpoint())
+        if rerr != nil {
+            return nil, fmt.Errorf("no discovered issuer for UMA as_uri: %w", rerr)
+        }
+        issuer = realmBase
+    }
+    challenge := fmt.Sprintf(`UMA realm=%q, as_uri=%q, ticket=%q`, provider.spec.Name, issuer, ticket)
+    headers := []*core.HeaderValueOption{{
+        Append: &wrappers.BoolValue{Value: false},
+        Header: &core.HeaderValue{
+            Key:   "www-authenticate",
+            Value: challenge,
+        },
+    }}
+    return &authpb.CheckResponse{
+        Status: &statuspb.Status{Code: 16},
+        HttpResponse: &authpb.CheckResponse_DeniedResponse{
+            DeniedResponse: &authpb.DeniedHttpResponse{
+                Status: &envoy_type.HttpStatus{
+                    Code: envoy_type.StatusCode_Unauthorized,
+                },
+                Headers: headers,
+                Body:    "permission denied; retry with an RPT obtained using the supplied ticket",
+            },
+        },
+    }, nil
+}
+
 // ============================================================
 // Envoy responses
 // ============================================================
@@ -523,21 +937,19 @@ func redactJSONBody(b []byte) string {
     return string(out)
 }
 
-func logHTTPRequest(tag string, method string, rawURL string, hdr http.Header, form url.Values) {
-    log.Printf("[HTTP-REQ][%s] %s %s", tag, method, rawURL)
-    log.Printf("[HTTP-REQ][%s] headers=%v", tag, redactHeaders(hdr))
+func logHTTPRequest(ctx context.Context, tag string, method string, rawURL string, hdr http.Header, form url.Values) {
+    ev := logging.WithContext(ctx).Debug().Str("tag", tag).Str("method", method).Str("url", rawURL).Interface("headers", redactHeaders(hdr))
     if form != nil {
-        log.Printf("[HTTP-REQ][%s] form=%v", tag, redactForm(form))
+        ev = ev.Interface("form", redactForm(form))
     }
+    ev.Msg("http request")
 }
 
-func logHTTPResponse(tag string, status int, hdr http.Header, bodyRedacted string, elapsed time.Duration) {
-    log.Printf("[HTTP-RES][%s] status=%d elapsed=%s", tag, status, elapsed)
-    log.Printf("[HTTP-RES][%s] headers=%v", tag, redactHeaders(hdr))
+func logHTTPResponse(ctx context.Context, tag string, status int, hdr http.Header, bodyRedacted string, elapsed time.Duration) {
     if len(bodyRedacted) > 4096 {
         bodyRedacted = bodyRedacted[:4096] + "...(truncated)"
     }
-    log.Printf("[HTTP-RES][%s] body=%s", tag, bodyRedacted)
+    logging.WithContext(ctx).Debug().Str("tag", tag).Int("status", status).Dur("elapsed", elapsed).Interface("headers", redactHeaders(hdr)).Str("body", bodyRedacted).Msg("http response")
 }
 
 // Extract Bearer token from Authorization header
@@ -557,43 +969,6 @@ func parseBearerToken(h string) (string, bool) {
     return rest, true
 }
 
-// Audience-only check (no signature verification).
-func checkAudienceOnly(jwt string, expectedAud string) (bool, error) {
-    parts := strings.Split(jwt, ".")
-    if len(parts) < 2 {
-        return false, fmt.Errorf("invalid jwt format")
-    }
-    payloadB64 := parts[1]
-    if m := len(payloadB64) % 4; m != 0 {
-        payloadB64 += strings.Repeat("=", 4-m)
-    }
-    payloadBytes, err := base64.URLEncoding.DecodeString(payloadB64)
-    if err != nil {
-        return false, fmt.Errorf("decode payload failed: %w", err)
-    }
-    var claims map[string]interface{}
-    if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-        return false, fmt.Errorf("unmarshal claims failed: %w", err)
-    }
-    aud, ok := claims["aud"]
-    if !ok {
-        return false, nil
-    }
-    switch v := aud.(type) {
-    case string:
-        return v == expectedAud, nil
-    case []interface{}:
-        for _, x := range v {
-            if xs, ok := x.(string); ok && xs == expectedAud {
-                return true, nil
-            }
-        }
-        return false, nil
-    default:
-        return false, nil
-    }
-}
-
 // extractRealmBase trims the standard suffix from Keycloak token endpoint and returns the realm base URL.
 // Expected format:
 //   https://<host>/realms/<realm>/protocol/openid-connect/token
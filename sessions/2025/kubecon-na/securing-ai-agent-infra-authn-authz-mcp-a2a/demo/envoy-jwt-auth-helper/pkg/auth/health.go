@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ============================================================
+// grpc.health.v1.Health
+// ============================================================
+
+// Ready reports whether the server is able to serve ext_authz requests.
+// Whenever NeedsJWTSource reports true (AccessTokenExchanger mode, or the
+// UMA ticket-challenge flow) this requires a JWTSource to have been
+// supplied via SetJWTSource; otherwise there is no such dependency.
+func (a *AuthServer) Ready() bool {
+	if !a.NeedsJWTSource() {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.config.jwtSource != nil
+}
+
+// healthServer adapts AuthServer.Ready to grpc_health_v1.HealthServer. It is
+// a separate type (rather than a method on AuthServer) because the health
+// service's Check/Watch names collide with authpb.AuthorizationServer's own
+// Check method.
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	auth *AuthServer
+}
+
+// NewHealthServer returns a grpc_health_v1.HealthServer backed by a's
+// readiness, suitable for registering alongside the Authorization service.
+func NewHealthServer(a *AuthServer) grpc_health_v1.HealthServer {
+	return &healthServer{auth: a}
+}
+
+// Check implements grpc_health_v1.HealthServer. The empty service name (the
+// convention for "the whole server") is the only one recognized; any other
+// service name is NOT_FOUND per the health-checking protocol.
+func (h *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.GetService() != "" {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	if h.auth.Ready() {
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+}
+
+// Watch implements grpc_health_v1.HealthServer. Streaming health watch is
+// not needed by Envoy's health_check cluster, which only polls Check.
+func (h *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "watch is not supported")
+}
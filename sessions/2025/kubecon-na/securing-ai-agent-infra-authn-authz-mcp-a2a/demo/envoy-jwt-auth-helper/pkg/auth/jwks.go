@@ -0,0 +1,516 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
+)
+
+// defaultJWKSMaxAge is the key-set refresh interval used when a JWKS
+// response carries no usable Cache-Control: max-age (absent, zero or
+// unparseable), matching the OIDC discovery refresh interval main passes
+// to ProviderRegistry.StartDiscoveryRefresh.
+const defaultJWKSMaxAge = 10 * time.Minute
+
+// JWKSConfig controls checkAccessTokenWithJWKS. ExpectedIssuers, when
+// non-empty, is the allow-list checked against a verified token's iss; when
+// empty, the issuer published in the provider's own discovery document is
+// trusted instead. ExpectedAZPs, when non-empty, is the allow-list checked
+// against a verified token's azp (the client id of the application the
+// token was originally issued to, e.g. a frontend SPA's Keycloak client id
+// - a different principal from provider.spec.SVIDAudienceForKeycloak,
+// which is this resource server's own client id and is already checked as
+// aud); when empty, azp is left unchecked, since most deployments have more
+// than one legitimate client and there is nothing safe to default the
+// allow-list to. ClockSkew is the leeway applied to exp/nbf.
+// MinRefreshInterval rate-limits the on-demand JWKS refresh triggered by an
+// unrecognized kid, so a burst of tokens signed by an unknown key cannot be
+// used to flood a provider's jwks_uri.
+type JWKSConfig struct {
+	ExpectedIssuers    []string
+	ExpectedAZPs       []string
+	ClockSkew          time.Duration
+	MinRefreshInterval time.Duration
+}
+
+// JWKSVerifier performs full RS256/ES256 JWT signature verification against
+// a provider's published JWKS, in place of a base64-decode-only aud check
+// in AccessTokenValidatorWithDecision mode (a caller could
+// otherwise present a token with a forged aud and an invalid signature).
+// Key sets are discovered lazily per provider, preferring the jwks_uri/issuer
+// ProviderRegistry.RefreshDiscovery already resolved and falling back to
+// this verifier's own discovery (off the realm base implied by
+// TokenEndpoint) for providers with no Issuer/DiscoveryURL configured. Keys
+// are cached respecting the JWKS response's Cache-Control: max-age (floored
+// at MinRefreshInterval), and refreshed on demand when a token's kid isn't
+// in the cache. Safe for concurrent use.
+type JWKSVerifier struct {
+	httpClient *http.Client
+	cfg        JWKSConfig
+
+	mu   sync.Mutex
+	sets map[string]*jwksCacheEntry // provider name -> key set
+}
+
+// jwksCacheEntry is one provider's cached key set plus the issuer and
+// jwks_uri resolved from its discovery document.
+type jwksCacheEntry struct {
+	mu          sync.RWMutex
+	issuer      string
+	jwksURI     string
+	keys        map[string]*jwksKey
+	fetchedAt   time.Time
+	maxAge      time.Duration // from Cache-Control, floored at cfg.MinRefreshInterval
+	lastRefresh time.Time     // for on-demand refresh rate limiting
+}
+
+func (e *jwksCacheEntry) stale() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.keys == nil {
+		return true
+	}
+	maxAge := e.maxAge
+	if maxAge <= 0 {
+		maxAge = defaultJWKSMaxAge
+	}
+	return time.Since(e.fetchedAt) > maxAge
+}
+
+func (e *jwksCacheEntry) lookup(kid string) (*jwksKey, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	k, ok := e.keys[kid]
+	return k, ok
+}
+
+// jwksKey is one parsed JWKS entry: the public key plus its declared alg
+// (checked against the token header's alg when present).
+type jwksKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// NewJWKSVerifier builds a JWKSVerifier. A zero MinRefreshInterval defaults
+// to 30s.
+func NewJWKSVerifier(httpClient *http.Client, cfg JWKSConfig) *JWKSVerifier {
+	if cfg.MinRefreshInterval <= 0 {
+		cfg.MinRefreshInterval = 30 * time.Second
+	}
+	return &JWKSVerifier{
+		httpClient: httpClient,
+		cfg:        cfg,
+		sets:       make(map[string]*jwksCacheEntry),
+	}
+}
+
+// checkAccessTokenWithJWKS verifies token's RS256/ES256 signature against
+// provider's JWKS and checks iss, aud (string or array), exp, nbf, and -
+// when present - azp. It returns a descriptive error on any failure; the
+// caller (AuthServer.Check) treats that as 401-with-challenge rather than
+// 403, since a fresh token may succeed where this one failed. On success it
+// returns the verified claims, so the caller can also inspect them for a
+// UMA RPT's authorization.permissions claim (see verifyRPT) without a
+// second signature verification pass.
+func (v *JWKSVerifier) checkAccessTokenWithJWKS(ctx context.Context, token string, provider *Provider) (jwt.MapClaims, error) {
+	kid, alg, err := peekJWTHeader(token)
+	if err != nil {
+		return nil, fmt.Errorf("parse jwt header: %w", err)
+	}
+
+	entry, err := v.ensureKeySet(ctx, provider)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	key, ok := entry.lookup(kid)
+	if !ok {
+		entry, err = v.refreshOnUnknownKid(ctx, provider, entry, kid)
+		if err != nil {
+			return nil, err
+		}
+		key, ok = entry.lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("no key for kid %q", kid)
+		}
+	}
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("token alg %q does not match jwks key alg %q for kid %q", alg, key.alg, kid)
+	}
+
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "ES256"}), jwt.WithLeeway(v.cfg.ClockSkew))
+	if _, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return key.key, nil
+	}); err != nil {
+		return nil, fmt.Errorf("signature/claims verification failed: %w", err)
+	}
+
+	entry.mu.RLock()
+	issuer := entry.issuer
+	entry.mu.RUnlock()
+	if err := checkIssuer(claims, issuer, v.cfg.ExpectedIssuers); err != nil {
+		return nil, err
+	}
+	if err := checkAudience(claims, provider.spec.SVIDAudienceForKeycloak); err != nil {
+		return nil, err
+	}
+	if err := checkAZP(claims, v.cfg.ExpectedAZPs); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ensureKeySet returns provider's cached key set, fetching (or refreshing a
+// stale one) as needed. A refresh failure on an already-populated entry is
+// logged and the last-known-good keys are served, so a transient IdP outage
+// does not take token validation down; a refresh failure on an empty entry
+// is returned to the caller.
+func (v *JWKSVerifier) ensureKeySet(ctx context.Context, provider *Provider) (*jwksCacheEntry, error) {
+	v.mu.Lock()
+	entry, ok := v.sets[provider.spec.Name]
+	if !ok {
+		entry = &jwksCacheEntry{}
+		v.sets[provider.spec.Name] = entry
+	}
+	v.mu.Unlock()
+
+	if !entry.stale() {
+		return entry, nil
+	}
+	if err := v.refreshKeySet(ctx, provider, entry); err != nil {
+		entry.mu.RLock()
+		hasKeys := entry.keys != nil
+		entry.mu.RUnlock()
+		if hasKeys {
+			logging.WithContext(ctx).Warn().Err(err).Str("provider", provider.spec.Name).Msg("JWKS refresh failed; keeping last-known keys")
+			return entry, nil
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+// refreshOnUnknownKid refreshes provider's key set outside the normal
+// max-age schedule because kid wasn't found, rate-limited by
+// cfg.MinRefreshInterval so a burst of tokens with a bogus kid cannot be
+// used to flood the provider's jwks_uri.
+func (v *JWKSVerifier) refreshOnUnknownKid(ctx context.Context, provider *Provider, entry *jwksCacheEntry, kid string) (*jwksCacheEntry, error) {
+	entry.mu.RLock()
+	sinceRefresh := time.Since(entry.lastRefresh)
+	entry.mu.RUnlock()
+	if sinceRefresh < v.cfg.MinRefreshInterval {
+		return entry, fmt.Errorf("kid %q not found and last JWKS refresh was %s ago (rate-limited at %s)", kid, sinceRefresh.Round(time.Millisecond), v.cfg.MinRefreshInterval)
+	}
+	if err := v.refreshKeySet(ctx, provider, entry); err != nil {
+		return entry, fmt.Errorf("refresh jwks for unknown kid %q: %w", kid, err)
+	}
+	return entry, nil
+}
+
+// refreshKeySet resolves provider's jwks_uri - preferring the metadata
+// ProviderRegistry.RefreshDiscovery already resolved from Issuer/
+// DiscoveryURL, and falling back to this verifier's own discovery (off the
+// realm base implied by TokenEndpoint) only for providers configured solely
+// via the legacy TokenEndpoint override - and fetches its JWKS, replacing
+// entry's cached keys.
+func (v *JWKSVerifier) refreshKeySet(ctx context.Context, provider *Provider, entry *jwksCacheEntry) error {
+	jwksURI, issuer := provider.JWKSURI(), provider.Issuer()
+
+	if jwksURI == "" {
+		realmBase, err := extractRealmBase(provider.TokenEndpoint())
+		if err != nil {
+			return err
+		}
+		doc, err := fetchOIDCDiscoveryDocument(ctx, v.httpClient, realmBase+"/.well-known/openid-configuration")
+		if err != nil {
+			return fmt.Errorf("oidc discovery: %w", err)
+		}
+		if doc.JWKSURI == "" {
+			return fmt.Errorf("discovery document has no jwks_uri")
+		}
+		jwksURI, issuer = doc.JWKSURI, doc.Issuer
+	}
+
+	keys, maxAge, err := fetchJWKS(ctx, v.httpClient, jwksURI)
+	if err != nil {
+		return err
+	}
+	if maxAge <= 0 {
+		maxAge = defaultJWKSMaxAge
+	}
+	if maxAge < v.cfg.MinRefreshInterval {
+		maxAge = v.cfg.MinRefreshInterval
+	}
+
+	now := time.Now()
+	entry.mu.Lock()
+	entry.jwksURI = jwksURI
+	entry.issuer = issuer
+	entry.keys = keys
+	entry.fetchedAt = now
+	entry.lastRefresh = now
+	entry.maxAge = maxAge
+	entry.mu.Unlock()
+
+	logging.WithContext(ctx).Info().Str("provider", provider.spec.Name).Str("jwks_uri", jwksURI).Int("keys", len(keys)).Msg("JWKS refreshed")
+	return nil
+}
+
+// ============================================================
+// HTTP fetches (JWKS; the discovery document fetch is shared with
+// ProviderRegistry - see fetchOIDCDiscoveryDocument in provider.go)
+// ============================================================
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jsonWebKey covers the RSA (kty=RSA) and EC (kty=EC, crv=P-256) members
+// used by Keycloak's default realm keys; other key types are skipped.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches and parses the JWKS at jwksURI, returning it keyed by
+// kid plus the cache lifetime implied by the response's Cache-Control:
+// max-age (0 if absent/invalid).
+func fetchJWKS(ctx context.Context, httpClient *http.Client, jwksURI string) (map[string]*jwksKey, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("jwks %s returned %d", jwksURI, resp.StatusCode)
+	}
+	var set jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, 0, fmt.Errorf("decode jwks %s: %w", jwksURI, err)
+	}
+
+	keys := make(map[string]*jwksKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := parseJWKPublicKey(k)
+		if err != nil {
+			logging.L().Warn().Err(err).Str("jwks_uri", jwksURI).Str("kid", k.Kid).Str("kty", k.Kty).Msg("skipping unparseable JWKS key")
+			continue
+		}
+		keys[k.Kid] = &jwksKey{alg: k.Alg, key: pub}
+	}
+	return keys, maxAgeFromCacheControl(resp.Header.Get("Cache-Control")), nil
+}
+
+func maxAgeFromCacheControl(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || seconds <= 0 {
+			continue
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+func parseJWKPublicKey(k jsonWebKey) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decode n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decode e: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		default:
+			return nil, fmt.Errorf("unsupported crv %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("decode x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("decode y: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
+
+// ============================================================
+// JWT header peek + claim checks
+// ============================================================
+
+// peekJWTHeader decodes a JWT's header (first segment) without verifying
+// anything, to learn which key (kid) and algorithm (alg) to verify with.
+func peekJWTHeader(token string) (kid string, alg string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("invalid jwt format")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("decode header: %w", err)
+	}
+	var header struct {
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return "", "", fmt.Errorf("unmarshal header: %w", err)
+	}
+	if header.Kid == "" {
+		return "", "", fmt.Errorf("token header has no kid")
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return "", "", fmt.Errorf("unsupported alg %q (want RS256 or ES256)", header.Alg)
+	}
+	return header.Kid, header.Alg, nil
+}
+
+func checkIssuer(claims jwt.MapClaims, discoveredIssuer string, expected []string) error {
+	iss, err := claims.GetIssuer()
+	if err != nil || iss == "" {
+		return fmt.Errorf("token has no iss claim")
+	}
+	allowed := expected
+	if len(allowed) == 0 {
+		if discoveredIssuer == "" {
+			return fmt.Errorf("no expected issuer configured or discovered; refusing to trust iss %q", iss)
+		}
+		allowed = []string{discoveredIssuer}
+	}
+	for _, a := range allowed {
+		if iss == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected iss %q", iss)
+}
+
+func checkAudience(claims jwt.MapClaims, expectedAud string) error {
+	aud, ok := claims["aud"]
+	if !ok {
+		return fmt.Errorf("token has no aud claim")
+	}
+	switch v := aud.(type) {
+	case string:
+		if v == expectedAud {
+			return nil
+		}
+	case []interface{}:
+		for _, x := range v {
+			if xs, ok := x.(string); ok && xs == expectedAud {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("aud does not include %q", expectedAud)
+}
+
+// checkAZP checks azp against the expected allow-list, when both the claim
+// and the allow-list are non-empty: azp is optional per the OIDC core spec,
+// and an empty allow-list means the deployment hasn't told us which
+// clients are legitimate, so there is nothing safe to check it against
+// (see JWKSConfig.ExpectedAZPs).
+func checkAZP(claims jwt.MapClaims, expected []string) error {
+	azp, ok := claims["azp"].(string)
+	if !ok || azp == "" || len(expected) == 0 {
+		return nil
+	}
+	for _, a := range expected {
+		if azp == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected azp %q", azp)
+}
+
+// verifyRPT inspects claims for a UMA RPT's authorization.permissions claim
+// - set by Keycloak on a token obtained via
+// grant_type=urn:ietf:params:oauth:grant-type:uma-ticket - and, if present,
+// checks whether it grants resourcePath for method. isRPT is false when
+// claims carries no authorization.permissions claim at all, meaning token is
+// a plain access token rather than an RPT; Check then falls back to
+// delegateDecision instead of trusting this result. Permissions are matched
+// by rsname against resourcePath, mirroring the "<path>#<method>" permission
+// string delegateDecision and requestPermissionTicket both request.
+func verifyRPT(claims jwt.MapClaims, resourcePath, method string) (allowed bool, isRPT bool) {
+	auth, ok := claims["authorization"].(map[string]interface{})
+	if !ok {
+		return false, false
+	}
+	rawPermissions, ok := auth["permissions"].([]interface{})
+	if !ok {
+		return false, false
+	}
+	scope := strings.ToLower(method)
+	for _, rp := range rawPermissions {
+		permission, ok := rp.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rsname, _ := permission["rsname"].(string)
+		if rsname != resourcePath {
+			continue
+		}
+		scopes, _ := permission["scopes"].([]interface{})
+		if len(scopes) == 0 {
+			return true, true // resource-level grant, no scope restriction
+		}
+		for _, s := range scopes {
+			if ss, ok := s.(string); ok && strings.EqualFold(ss, scope) {
+				return true, true
+			}
+		}
+	}
+	return false, true
+}
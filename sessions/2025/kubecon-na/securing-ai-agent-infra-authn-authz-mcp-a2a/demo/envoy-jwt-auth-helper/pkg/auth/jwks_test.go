@@ -0,0 +1,130 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// signedTestToken builds an RS256 JWT over claims, signed by key and tagged
+// with kid, the way Keycloak would sign an access token.
+func signedTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+    t.Helper()
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = kid
+    signed, err := token.SignedString(key)
+    if err != nil {
+        t.Fatalf("sign test token: %v", err)
+    }
+    return signed
+}
+
+func newTestVerifier(t *testing.T, cfg JWKSConfig, kid string, pub *rsa.PublicKey, issuer string) (*JWKSVerifier, *Provider) {
+    t.Helper()
+    v := NewJWKSVerifier(nil, cfg)
+    provider := &Provider{spec: ProviderSpec{Name: "test", SVIDAudienceForKeycloak: "backend-client"}}
+    v.sets[provider.spec.Name] = &jwksCacheEntry{
+        issuer:    issuer,
+        keys:      map[string]*jwksKey{kid: {alg: "RS256", key: pub}},
+        fetchedAt: time.Now(),
+        maxAge:    time.Hour,
+    }
+    return v, provider
+}
+
+func TestCheckAccessTokenWithJWKS(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("generate key: %v", err)
+    }
+    const kid = "test-key"
+    const issuer = "https://idp.example.com/realms/test"
+    now := time.Now()
+
+    baseClaims := func() jwt.MapClaims {
+        return jwt.MapClaims{
+            "iss": issuer,
+            "aud": "backend-client",
+            "exp": now.Add(time.Hour).Unix(),
+            "iat": now.Unix(),
+        }
+    }
+
+    t.Run("valid token is accepted", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{}, kid, &key.PublicKey, issuer)
+        token := signedTestToken(t, key, kid, baseClaims())
+        claims, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider)
+        if err != nil {
+            t.Fatalf("expected success, got %v", err)
+        }
+        if claims["iss"] != issuer {
+            t.Fatalf("claims not returned correctly: %+v", claims)
+        }
+    })
+
+    t.Run("wrong audience is rejected", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{}, kid, &key.PublicKey, issuer)
+        claims := baseClaims()
+        claims["aud"] = "some-other-client"
+        token := signedTestToken(t, key, kid, claims)
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err == nil {
+            t.Fatal("expected aud mismatch to be rejected")
+        }
+    })
+
+    t.Run("expired token is rejected", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{}, kid, &key.PublicKey, issuer)
+        claims := baseClaims()
+        claims["exp"] = now.Add(-time.Hour).Unix()
+        token := signedTestToken(t, key, kid, claims)
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err == nil {
+            t.Fatal("expected expired token to be rejected")
+        }
+    })
+
+    t.Run("signature from a different key is rejected", func(t *testing.T) {
+        otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+            t.Fatalf("generate key: %v", err)
+        }
+        v, provider := newTestVerifier(t, JWKSConfig{}, kid, &key.PublicKey, issuer)
+        token := signedTestToken(t, otherKey, kid, baseClaims())
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err == nil {
+            t.Fatal("expected a token signed by an untrusted key to be rejected")
+        }
+    })
+
+    t.Run("azp is unchecked when ExpectedAZPs is empty", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{}, kid, &key.PublicKey, issuer)
+        claims := baseClaims()
+        claims["azp"] = "some-frontend-client"
+        token := signedTestToken(t, key, kid, claims)
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err != nil {
+            t.Fatalf("expected azp to be ignored with no allow-list configured, got %v", err)
+        }
+    })
+
+    t.Run("azp outside the allow-list is rejected", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{ExpectedAZPs: []string{"frontend-a"}}, kid, &key.PublicKey, issuer)
+        claims := baseClaims()
+        claims["azp"] = "frontend-b"
+        token := signedTestToken(t, key, kid, claims)
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err == nil {
+            t.Fatal("expected azp outside the allow-list to be rejected")
+        }
+    })
+
+    t.Run("azp in the allow-list is accepted", func(t *testing.T) {
+        v, provider := newTestVerifier(t, JWKSConfig{ExpectedAZPs: []string{"frontend-a"}}, kid, &key.PublicKey, issuer)
+        claims := baseClaims()
+        claims["azp"] = "frontend-a"
+        token := signedTestToken(t, key, kid, claims)
+        if _, err := v.checkAccessTokenWithJWKS(context.Background(), token, provider); err != nil {
+            t.Fatalf("expected azp in the allow-list to be accepted, got %v", err)
+        }
+    })
+}
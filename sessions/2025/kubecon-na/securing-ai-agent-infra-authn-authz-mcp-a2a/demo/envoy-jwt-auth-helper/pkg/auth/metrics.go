@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ============================================================
+// Prometheus metrics
+// ============================================================
+//
+// These are package-level so that both AuthServer (ext_authz decisions,
+// token-exchange latency) and main (JWTSource refresh errors) can record
+// against them; main exposes them via promhttp.Handler() on the admin
+// listener.
+
+var (
+	authzCheckTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authz_check_total",
+		Help: "Count of ext_authz Check decisions, by mode and decision.",
+	}, []string{"mode", "decision"})
+
+	tokenExchangeLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "token_exchange_latency_seconds",
+		Help:    "Latency of token-exchange calls to Keycloak, by outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	jwtSourceRefreshErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jwt_source_refresh_errors_total",
+		Help: "Count of failed attempts to initialize or refresh the workload JWTSource.",
+	})
+
+	tokenCacheResultsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_cache_results_total",
+		Help: "Count of exchanged-token cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	authzKeycloakRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authz_keycloak_request_duration_seconds",
+		Help:    "Latency of outbound calls to Keycloak, by operation and HTTP status (or \"error\").",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op", "status"})
+
+	authzTokenExchangeErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authz_token_exchange_errors_total",
+		Help: "Count of failed RFC 8693 token-exchange attempts, by reason.",
+	}, []string{"reason"})
+)
+
+// recordDecision increments the ext_authz decision counter for this mode.
+func recordDecision(mode Mode, decision string) {
+	authzCheckTotal.WithLabelValues(mode.String(), decision).Inc()
+}
+
+// recordTokenExchangeLatency records the duration of a token-exchange call.
+func recordTokenExchangeLatency(outcome string, seconds float64) {
+	tokenExchangeLatencySeconds.WithLabelValues(outcome).Observe(seconds)
+}
+
+// RecordJWTSourceRefreshError increments the JWTSource-refresh-errors
+// counter. It is exported so main can call it from the JWTSource init/retry
+// loop, which lives outside this package.
+func RecordJWTSourceRefreshError() {
+	jwtSourceRefreshErrorsTotal.Inc()
+}
+
+// recordCacheResult increments the exchanged-token cache hit/miss counter.
+func recordCacheResult(result string) {
+	tokenCacheResultsTotal.WithLabelValues(result).Inc()
+}
+
+// recordKeycloakRequestDuration observes one outbound Keycloak call's
+// latency, by operation (doPost's tag, or "token-exchange") and status.
+func recordKeycloakRequestDuration(op, status string, seconds float64) {
+	authzKeycloakRequestDurationSeconds.WithLabelValues(op, status).Observe(seconds)
+}
+
+// recordTokenExchangeError increments the token-exchange error counter
+// for reason (e.g. "jwt_source_not_ready", "circuit_open", "keycloak_503").
+func recordTokenExchangeError(reason string) {
+	authzTokenExchangeErrorsTotal.WithLabelValues(reason).Inc()
+}
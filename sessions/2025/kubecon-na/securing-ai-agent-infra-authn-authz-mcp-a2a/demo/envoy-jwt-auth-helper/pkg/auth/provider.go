@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
+)
+
+// ProviderSpec is the static description of one RFC 8693 token-exchange /
+// UMA target, as supplied by main from the config's provider blocks (or
+// synthesized from the legacy single-provider fields for backward
+// compatibility). It is immutable once handed to NewProviderRegistry; only
+// the resolved metadata (see Provider) changes at runtime.
+type ProviderSpec struct {
+	Name                    string
+	Authority               string // :authority/Host match key; "" is the fallback used when no other provider matches
+	DownstreamAudience      string
+	SVIDAudienceForKeycloak string
+	TokenEndpoint           string // closed-environment override: used as-is when discovery is unset or unreachable
+	Issuer                  string // OIDC issuer; when set, metadata is (re-)resolved from <Issuer>/.well-known/openid-configuration
+	DiscoveryURL            string // legacy alternative to Issuer: a full discovery-document URL, used as-is when Issuer is empty
+}
+
+// providerMetadata is the subset of a provider's OIDC discovery document
+// this package consults: TokenEndpoint (RFC 8693 exchange and UMA ticket
+// delegation), JWKSURI and Issuer (JWKSVerifier), and GrantTypesSupported
+// (sanity-checked against what this helper requires - see
+// validateGrantTypesSupported).
+type providerMetadata struct {
+	issuer              string
+	tokenEndpoint       string
+	jwksURI             string
+	grantTypesSupported []string
+	fetchedAt           time.Time
+}
+
+// Provider is a ProviderSpec plus its last-resolved metadata.
+type Provider struct {
+	spec ProviderSpec
+	mu   sync.RWMutex
+	meta providerMetadata
+}
+
+// TokenEndpoint returns the provider's current token endpoint: the value
+// last resolved via OIDC discovery, or the static ProviderSpec.TokenEndpoint
+// override when discovery is unset or has not yet succeeded.
+func (p *Provider) TokenEndpoint() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.meta.tokenEndpoint != "" {
+		return p.meta.tokenEndpoint
+	}
+	return p.spec.TokenEndpoint
+}
+
+// Issuer returns the issuer from the provider's last-resolved discovery
+// document, or "" if discovery has not yet succeeded (or isn't configured).
+func (p *Provider) Issuer() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.meta.issuer
+}
+
+// JWKSURI returns the jwks_uri from the provider's last-resolved discovery
+// document, or "" if discovery has not yet succeeded (or isn't configured).
+func (p *Provider) JWKSURI() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.meta.jwksURI
+}
+
+func (p *Provider) setMetadata(meta providerMetadata) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta = meta
+}
+
+func (p *Provider) metadataSnapshot() providerMetadata {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.meta
+}
+
+// ProviderRegistry selects a Provider per request by :authority/Host,
+// falling back to a default provider (the sole configured provider, or the
+// one declared with no Authority) when there is no exact match. This lets
+// one auth-helper instance front several IdPs/audiences instead of
+// requiring a sidecar per issuer.
+type ProviderRegistry struct {
+	mu          sync.RWMutex
+	byAuthority map[string]*Provider
+	all         []*Provider
+	def         *Provider
+	httpClient  *http.Client
+}
+
+// NewProviderRegistry builds a ProviderRegistry from specs, which must be
+// non-empty.
+func NewProviderRegistry(specs []ProviderSpec, httpClient *http.Client) (*ProviderRegistry, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+	r := &ProviderRegistry{httpClient: httpClient}
+	r.Replace(specs)
+	return r, nil
+}
+
+// Replace atomically swaps the full set of providers, e.g. after a config
+// hot-reload. Providers that are unchanged (same Authority and Name) keep
+// their previously discovered metadata; this is a best-effort match
+// on Authority+Name rather than a diff, since provider sets are small and
+// reloads are infrequent.
+func (r *ProviderRegistry) Replace(specs []ProviderSpec) {
+	r.mu.RLock()
+	previous := make(map[string]*Provider, len(r.all))
+	for _, p := range r.all {
+		previous[p.spec.Name] = p
+	}
+	r.mu.RUnlock()
+
+	byAuthority := make(map[string]*Provider, len(specs))
+	all := make([]*Provider, 0, len(specs))
+	var def *Provider
+	for _, spec := range specs {
+		p := &Provider{spec: spec}
+		if prev, ok := previous[spec.Name]; ok && prev.spec.Authority == spec.Authority {
+			p.meta = prev.metadataSnapshot()
+		}
+		all = append(all, p)
+		if spec.Authority != "" {
+			byAuthority[spec.Authority] = p
+		}
+		if spec.Authority == "" || len(specs) == 1 {
+			def = p
+		}
+	}
+
+	r.mu.Lock()
+	r.byAuthority = byAuthority
+	r.all = all
+	r.def = def
+	r.mu.Unlock()
+
+	logging.L().Info().Int("providers", len(specs)).Msg("provider registry updated")
+}
+
+// Select returns the Provider matching authority (the caller's :authority
+// or Host header), falling back to the default provider when there is no
+// exact match.
+func (r *ProviderRegistry) Select(authority string) (*Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p, ok := r.byAuthority[authority]; ok {
+		return p, nil
+	}
+	if r.def != nil {
+		return r.def, nil
+	}
+	return nil, fmt.Errorf("no provider configured for authority %q", authority)
+}
+
+// requiredGrantTypes are the RFC 8693 / UMA grant types this helper relies
+// on, depending on mode (token exchange, UMA ticket delegation
+// respectively). Advertised as grant_types_supported in a compliant
+// provider's discovery document.
+var requiredGrantTypes = []string{
+	"urn:ietf:params:oauth:grant-type:token-exchange",
+	"urn:ietf:params:oauth:grant-type:uma-ticket",
+}
+
+// RefreshDiscovery resolves metadata (token_endpoint, jwks_uri, issuer,
+// grant_types_supported) for every provider whose Issuer or DiscoveryURL is
+// set, via its OIDC discovery document (.well-known/openid-configuration).
+// Providers with neither are left untouched, so they keep relying solely on
+// ProviderSpec.TokenEndpoint. A failed refresh logs a warning and keeps the
+// provider's last-known-good metadata, so a transient IdP outage does not
+// take token exchange down.
+func (r *ProviderRegistry) RefreshDiscovery(ctx context.Context) {
+	r.mu.RLock()
+	providers := append([]*Provider(nil), r.all...)
+	r.mu.RUnlock()
+
+	for _, p := range providers {
+		discoveryURL := p.spec.DiscoveryURL
+		if p.spec.Issuer != "" {
+			discoveryURL = strings.TrimSuffix(p.spec.Issuer, "/") + "/.well-known/openid-configuration"
+		}
+		if discoveryURL == "" {
+			continue
+		}
+		doc, err := fetchOIDCDiscoveryDocument(ctx, r.httpClient, discoveryURL)
+		if err != nil {
+			logging.L().Warn().Err(err).Str("provider", p.spec.Name).Str("discovery_url", discoveryURL).Msg("OIDC discovery failed; keeping last-known metadata")
+			continue
+		}
+		if doc.TokenEndpoint == "" {
+			logging.L().Warn().Str("provider", p.spec.Name).Str("discovery_url", discoveryURL).Msg("discovery document has no token_endpoint; keeping last-known metadata")
+			continue
+		}
+		validateGrantTypesSupported(p.spec.Name, doc.GrantTypesSupported)
+		p.setMetadata(providerMetadata{
+			issuer:              doc.Issuer,
+			tokenEndpoint:       doc.TokenEndpoint,
+			jwksURI:             doc.JWKSURI,
+			grantTypesSupported: doc.GrantTypesSupported,
+			fetchedAt:           time.Now(),
+		})
+		logging.L().Info().Str("provider", p.spec.Name).Str("token_endpoint", doc.TokenEndpoint).Str("jwks_uri", doc.JWKSURI).Msg("OIDC discovery resolved provider metadata")
+	}
+}
+
+// validateGrantTypesSupported logs a warning, per missing grant type, when
+// a provider's discovery document doesn't advertise one of
+// requiredGrantTypes. Non-fatal: some IdPs omit grant_types_supported
+// entirely while still accepting the grant, so this is a diagnostic aid
+// rather than a hard requirement.
+func validateGrantTypesSupported(providerName string, advertised []string) {
+	if len(advertised) == 0 {
+		return
+	}
+	supported := make(map[string]bool, len(advertised))
+	for _, gt := range advertised {
+		supported[gt] = true
+	}
+	for _, want := range requiredGrantTypes {
+		if !supported[want] {
+			logging.L().Warn().Str("provider", providerName).Str("grant_type", want).Msg("provider's discovery document does not advertise this grant type in grant_types_supported")
+		}
+	}
+}
+
+// StartDiscoveryRefresh runs RefreshDiscovery once immediately, then again
+// every interval until ctx is cancelled.
+func (r *ProviderRegistry) StartDiscoveryRefresh(ctx context.Context, interval time.Duration) {
+	r.RefreshDiscovery(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.RefreshDiscovery(ctx)
+			}
+		}
+	}()
+}
+
+// oidcDiscoveryDocument is the subset of an OIDC discovery document
+// (.well-known/openid-configuration) this package consults.
+type oidcDiscoveryDocument struct {
+	Issuer              string   `json:"issuer"`
+	TokenEndpoint       string   `json:"token_endpoint"`
+	JWKSURI             string   `json:"jwks_uri"`
+	GrantTypesSupported []string `json:"grant_types_supported"`
+}
+
+// fetchOIDCDiscoveryDocument fetches and parses the OIDC discovery document
+// at discoveryURL.
+func fetchOIDCDiscoveryDocument(ctx context.Context, httpClient *http.Client, discoveryURL string) (*oidcDiscoveryDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document %s returned %d", discoveryURL, resp.StatusCode)
+	}
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode discovery document %s: %w", discoveryURL, err)
+	}
+	return &doc, nil
+}
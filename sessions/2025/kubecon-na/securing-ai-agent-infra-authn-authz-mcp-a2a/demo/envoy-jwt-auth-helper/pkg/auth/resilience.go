@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// Retry with exponential backoff + jitter, and per-endpoint circuit
+// breaking, for outbound calls to Keycloak (see AuthServer.doPost). A
+// Keycloak blip or slow key rotation otherwise surfaces to every in-flight
+// caller as a plain error indistinguishable from a genuine permission
+// denial, and a recovering Keycloak gets hit with every request that piled
+// up while it was down.
+// ============================================================
+
+// RetryConfig bounds doPost's retry of a single outbound call: up to
+// MaxRetries additional attempts, each after a full-jitter exponential
+// backoff starting at BaseDelay (see backoffWithJitter). Only network
+// errors and 5xx responses are retried - a 4xx is the caller's fault and
+// retrying it would not help.
+type RetryConfig struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+}
+
+// BreakerConfig bounds a circuitBreaker: it trips (opens) after
+// FailureThreshold consecutive failures observed within Window, and
+// half-opens - letting exactly one probe request through - after Cooldown.
+type BreakerConfig struct {
+	FailureThreshold int
+	Window           time.Duration
+	Cooldown         time.Duration
+}
+
+// ResilienceConfig bundles RetryConfig and BreakerConfig for NewAuthServer.
+type ResilienceConfig struct {
+	Retry   RetryConfig
+	Breaker BreakerConfig
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker tracks one endpoint's recent failures. Safe for
+// concurrent use.
+type circuitBreaker struct {
+	cfg BreakerConfig
+
+	mu            sync.Mutex
+	state         breakerState
+	failures      int
+	windowStarted time.Time
+	openedAt      time.Time
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, state: breakerClosed}
+}
+
+// allow reports whether a request may proceed. When the breaker is open
+// and cfg.Cooldown hasn't elapsed since it tripped, it returns false and
+// the remaining cooldown, for the caller to surface as Retry-After. Once
+// Cooldown elapses, the caller that observes this first claims the single
+// probe slot by transitioning the breaker to half-open itself (under the
+// same lock) and is the only one to get true back; every other concurrent
+// caller sees the already-half-open state and is denied until
+// recordResult resolves the probe, closing the breaker again or re-opening
+// it for another full cooldown.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true, 0
+	case breakerHalfOpen:
+		return false, b.cfg.Cooldown
+	}
+	remaining := b.cfg.Cooldown - time.Since(b.openedAt)
+	if remaining > 0 {
+		return false, remaining
+	}
+	b.state = breakerHalfOpen
+	return true, 0
+}
+
+// recordResult updates the breaker's failure count and state from the
+// outcome of a request that allow most recently permitted.
+func (b *circuitBreaker) recordResult(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return
+	}
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.windowStarted) > b.cfg.Window {
+		b.windowStarted = now
+		b.failures = 0
+	}
+	b.failures++
+	if b.failures >= b.cfg.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+// breakerRegistry hands out one circuitBreaker per endpoint (keyed by URL),
+// created lazily on first use. Safe for concurrent use.
+type breakerRegistry struct {
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerRegistry(cfg BreakerConfig) *breakerRegistry {
+	return &breakerRegistry{cfg: cfg, breakers: make(map[string]*circuitBreaker)}
+}
+
+func (r *breakerRegistry) get(endpoint string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[endpoint]
+	if !ok {
+		b = newCircuitBreaker(r.cfg)
+		r.breakers[endpoint] = b
+	}
+	return b
+}
+
+// CircuitOpenError is returned by AuthServer.doPost when endpoint's
+// circuit breaker is open, instead of attempting (and presumably failing)
+// the request. Check translates it to a 503 with a Retry-After matching
+// RetryAfter, rather than the 403/PERMISSION_DENIED a genuine decision
+// denial gets - a breaker trip means Keycloak looks unavailable, not that
+// the caller lacks permission.
+type CircuitOpenError struct {
+	Endpoint   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s; retry after %s", e.Endpoint, e.RetryAfter.Round(time.Second))
+}
+
+// isRetryableStatus reports whether status warrants a retry: any 5xx. A
+// 4xx means the request itself was rejected (bad token, bad request) and
+// retrying it unchanged would not help.
+func isRetryableStatus(status int) bool {
+	return status >= 500 && status < 600
+}
+
+// backoffWithJitter returns the delay before retry attempt (0-indexed),
+// using full jitter: a random duration in [0, base*2^attempt]. Full jitter
+// (vs. capped or no jitter) spreads out retries from a batch of requests
+// that failed at the same moment, avoiding a new thundering herd on retry.
+func backoffWithJitter(base time.Duration, attempt int) time.Duration {
+	max := base << attempt // base * 2^attempt
+	if max <= 0 {          // overflow guard for a pathologically large attempt
+		max = base
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
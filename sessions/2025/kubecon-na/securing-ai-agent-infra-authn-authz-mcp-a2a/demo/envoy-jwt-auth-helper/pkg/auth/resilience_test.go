@@ -0,0 +1,57 @@
+package auth
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// TestCircuitBreakerHalfOpenAdmitsExactlyOneProbe exercises the scenario
+// from the bug this guards against: once cooldown has elapsed, many
+// concurrent callers race into allow() at the same instant, but only one
+// of them may get the half-open probe.
+func TestCircuitBreakerHalfOpenAdmitsExactlyOneProbe(t *testing.T) {
+    b := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, Window: time.Minute, Cooldown: time.Millisecond})
+    b.recordResult(false) // trip the breaker
+    time.Sleep(2 * time.Millisecond)
+
+    const callers = 20
+    var wg sync.WaitGroup
+    var admitted int32
+    var mu sync.Mutex
+    wg.Add(callers)
+    for i := 0; i < callers; i++ {
+        go func() {
+            defer wg.Done()
+            if allowed, _ := b.allow(); allowed {
+                mu.Lock()
+                admitted++
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+
+    if admitted != 1 {
+        t.Fatalf("admitted = %d, want exactly 1 probe through the half-open breaker", admitted)
+    }
+}
+
+func TestCircuitBreakerRecordResultResolvesHalfOpen(t *testing.T) {
+    b := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, Window: time.Minute, Cooldown: time.Millisecond})
+    b.recordResult(false)
+    time.Sleep(2 * time.Millisecond)
+
+    allowed, _ := b.allow()
+    if !allowed {
+        t.Fatalf("expected the first caller after cooldown to get the probe")
+    }
+    if allowed, _ := b.allow(); allowed {
+        t.Fatalf("expected a second concurrent caller to be denied while the probe is in flight")
+    }
+
+    b.recordResult(true)
+    if allowed, _ := b.allow(); !allowed {
+        t.Fatalf("expected the breaker to be closed after a successful probe")
+    }
+}
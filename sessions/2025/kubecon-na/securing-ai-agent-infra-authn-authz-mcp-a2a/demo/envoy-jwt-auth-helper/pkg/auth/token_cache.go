@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// tokenCacheConfig bounds TokenCache's size and the minimum remaining
+// lifetime a token must have to be worth caching.
+type tokenCacheConfig struct {
+	enabled    bool          // false disables caching entirely; get always misses and set is a no-op
+	maxEntries int           // 0 means unbounded
+	minTTL     time.Duration // exchanged tokens with less TTL than this are not cached
+	leeway     time.Duration // subtracted from the upstream's expires_in before comparing against minTTL
+}
+
+// CacheMetrics receives TokenCache hit/miss events, so an operator wanting
+// a metrics backend other than the package's own Prometheus counters (see
+// metrics.go) can supply their own. NewTokenCache defaults to the
+// Prometheus-backed implementation when metrics is nil.
+type CacheMetrics interface {
+	RecordCacheResult(result string) // "hit" or "miss"
+}
+
+// prometheusCacheMetrics is the default CacheMetrics, recording against the
+// package-level tokenCacheResultsTotal counter.
+type prometheusCacheMetrics struct{}
+
+func (prometheusCacheMetrics) RecordCacheResult(result string) {
+	recordCacheResult(result)
+}
+
+// TokenCache is a size-bounded LRU of previously exchanged downstream
+// tokens (see exchangeCacheKey for the key format), plus the
+// singleflight.Group that exchangeAccessToken uses to collapse concurrent
+// identical exchanges into one upstream call. Token exchange is on the hot
+// path of every ext_authz call in access_token_exchanger mode, and Envoy
+// issues ext_authz once per HTTP request, so both matter under load.
+// Construct via NewTokenCache and pass to NewAuthServer.
+type TokenCache struct {
+	cfg     tokenCacheConfig
+	metrics CacheMetrics
+
+	mu    sync.Mutex
+	ll    *list.List               // most-recently-used entry at the front
+	items map[string]*list.Element // key -> element in ll, Value is *tokenCacheEntry
+
+	group singleflight.Group
+}
+
+type tokenCacheEntry struct {
+	key       string
+	token     string
+	expiresAt time.Time
+}
+
+// NewTokenCache builds a TokenCache. When enabled is false, get always
+// misses and set is a no-op - call sites still pay for the Keycloak
+// round-trip but the rest of the caching machinery (singleflight
+// coalescing, cacheTTL computation) is unaffected. maxEntries bounds the
+// LRU (<= 0 means unbounded; size-bounding is then left to minTTL/leeway
+// keeping entries short-lived). minTTL and leeway are applied to an
+// exchanged token's expires_in (see doExchangeAccessToken) to decide
+// whether, and for how long, it is cached. metrics records hit/miss
+// counts; a nil metrics defaults to the package's Prometheus counters.
+func NewTokenCache(enabled bool, maxEntries int, minTTL, leeway time.Duration, metrics CacheMetrics) *TokenCache {
+	if metrics == nil {
+		metrics = prometheusCacheMetrics{}
+	}
+	return &TokenCache{
+		cfg:     tokenCacheConfig{enabled: enabled, maxEntries: maxEntries, minTTL: minTTL, leeway: leeway},
+		metrics: metrics,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached token for key, if present and not yet expired,
+// recording a hit or miss against c.metrics either way.
+func (c *TokenCache) get(key string) (string, bool) {
+	if !c.cfg.enabled {
+		c.metrics.RecordCacheResult("miss")
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.metrics.RecordCacheResult("miss")
+		return "", false
+	}
+	entry := el.Value.(*tokenCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.metrics.RecordCacheResult("miss")
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	c.metrics.RecordCacheResult("hit")
+	return entry.token, true
+}
+
+// set stores token under key with the given expiry, evicting the
+// least-recently-used entry if the cache is at capacity. A no-op when the
+// cache is disabled.
+func (c *TokenCache) set(key string, token string, expiresAt time.Time) {
+	if !c.cfg.enabled {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*tokenCacheEntry).token = token
+		el.Value.(*tokenCacheEntry).expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&tokenCacheEntry{key: key, token: token, expiresAt: expiresAt})
+	c.items[key] = el
+	if c.cfg.maxEntries > 0 {
+		for c.ll.Len() > c.cfg.maxEntries {
+			oldest := c.ll.Back()
+			if oldest == nil {
+				break
+			}
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*tokenCacheEntry).key)
+		}
+	}
+}
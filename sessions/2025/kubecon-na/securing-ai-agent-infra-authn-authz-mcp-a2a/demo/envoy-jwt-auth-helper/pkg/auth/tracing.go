@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ============================================================
+// OpenTelemetry tracing
+// ============================================================
+//
+// AuthServer.Check and the outbound Keycloak calls it makes (token
+// exchange, UMA decision delegation, UMA ticket issuance) are wrapped in
+// spans so a decision can be correlated end-to-end with the caller's own
+// trace, not just grepped out of the log stream. The module works against
+// whatever TracerProvider is registered globally via otel.SetTracerProvider
+// (main does this once at startup if tracing is configured); with none
+// registered, otel's no-op provider applies and this instrumentation costs
+// nothing beyond the Extract/Start calls below.
+
+var tracer = otel.Tracer("github.com/spiffe/envoy-jwt-auth-helper/pkg/auth")
+
+// extractTraceContext propagates the incoming traceparent/tracestate
+// headers (and any other registered propagator's headers) from Envoy's
+// ext_authz CheckRequest into ctx, so the span Check starts is a child of
+// the caller's own span rather than the root of a new trace.
+func extractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, envoyHeaderCarrier(headers))
+}
+
+// envoyHeaderCarrier adapts the lower-cased header map Envoy hands
+// ext_authz (req.Attributes.Request.Http.Headers) to otel's
+// propagation.TextMapCarrier.
+type envoyHeaderCarrier map[string]string
+
+func (c envoyHeaderCarrier) Get(key string) string { return c[strings.ToLower(key)] }
+
+func (c envoyHeaderCarrier) Set(key, value string) { c[strings.ToLower(key)] = value }
+
+func (c envoyHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// recordCheckOutcome annotates span with the decision Check reached
+// (allow/deny/unavailable) and a short machine-readable reason, and
+// increments the authz_check_total{mode,decision} counter (see
+// metrics.go).
+func recordCheckOutcome(span trace.Span, mode Mode, decision, reason string) {
+	recordDecision(mode, decision)
+	span.SetAttributes(
+		attribute.String("authz.decision", decision),
+		attribute.String("authz.reason", reason),
+	)
+	if decision == "unavailable" {
+		span.SetStatus(codes.Error, reason)
+	}
+}
+
+// startKeycloakSpan starts a child span around one outbound call to
+// Keycloak. op identifies the call the same way doPost's tag does
+// ("token-exchange", "uma-decision", "uma-pat", "uma-ticket").
+func startKeycloakSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "keycloak."+op, trace.WithAttributes(attribute.String("authz.op", op)))
+}
+
+// endKeycloakSpan records the HTTP outcome of a Keycloak call - status (0
+// if the request never got a response, e.g. a network error) and wall
+// time - on span, ends it, and observes the same pair against the
+// authz_keycloak_request_duration_seconds histogram.
+func endKeycloakSpan(span trace.Span, op string, status int, duration time.Duration, err error) {
+	statusLabel := keycloakStatusLabel(status, err)
+	span.SetAttributes(
+		attribute.Int("http.status_code", status),
+		attribute.Float64("http.request.duration", duration.Seconds()),
+	)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	recordKeycloakRequestDuration(op, statusLabel, duration.Seconds())
+}
+
+// keycloakStatusLabel is the "status" label value for
+// authz_keycloak_request_duration_seconds: the numeric HTTP status, or
+// "error" when the call never completed (network error, context
+// cancellation). A call refused by an open circuit breaker never reaches
+// doPostOnce, so it gets no span and no observation here.
+func keycloakStatusLabel(status int, err error) string {
+	if err != nil || status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+    "testing"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyRPT(t *testing.T) {
+    tests := []struct {
+        name         string
+        claims       jwt.MapClaims
+        resourcePath string
+        method       string
+        wantAllowed  bool
+        wantIsRPT    bool
+    }{
+        {
+            name:         "plain access token has no authorization claim",
+            claims:       jwt.MapClaims{"sub": "user1"},
+            resourcePath: "/orders",
+            method:       "GET",
+            wantAllowed:  false,
+            wantIsRPT:    false,
+        },
+        {
+            name: "rpt grants the requested resource and scope",
+            claims: jwt.MapClaims{
+                "authorization": map[string]interface{}{
+                    "permissions": []interface{}{
+                        map[string]interface{}{
+                            "rsname": "/orders",
+                            "scopes": []interface{}{"GET", "POST"},
+                        },
+                    },
+                },
+            },
+            resourcePath: "/orders",
+            method:       "GET",
+            wantAllowed:  true,
+            wantIsRPT:    true,
+        },
+        {
+            name: "rpt grants the resource with no scope restriction",
+            claims: jwt.MapClaims{
+                "authorization": map[string]interface{}{
+                    "permissions": []interface{}{
+                        map[string]interface{}{
+                            "rsname": "/orders",
+                        },
+                    },
+                },
+            },
+            resourcePath: "/orders",
+            method:       "DELETE",
+            wantAllowed:  true,
+            wantIsRPT:    true,
+        },
+        {
+            name: "rpt for a different resource is not granted",
+            claims: jwt.MapClaims{
+                "authorization": map[string]interface{}{
+                    "permissions": []interface{}{
+                        map[string]interface{}{
+                            "rsname": "/invoices",
+                            "scopes": []interface{}{"GET"},
+                        },
+                    },
+                },
+            },
+            resourcePath: "/orders",
+            method:       "GET",
+            wantAllowed:  false,
+            wantIsRPT:    true,
+        },
+        {
+            name: "rpt for the resource but wrong scope is not granted",
+            claims: jwt.MapClaims{
+                "authorization": map[string]interface{}{
+                    "permissions": []interface{}{
+                        map[string]interface{}{
+                            "rsname": "/orders",
+                            "scopes": []interface{}{"GET"},
+                        },
+                    },
+                },
+            },
+            resourcePath: "/orders",
+            method:       "DELETE",
+            wantAllowed:  false,
+            wantIsRPT:    true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            allowed, isRPT := verifyRPT(tt.claims, tt.resourcePath, tt.method)
+            if allowed != tt.wantAllowed || isRPT != tt.wantIsRPT {
+                t.Fatalf("verifyRPT() = (%v, %v), want (%v, %v)", allowed, isRPT, tt.wantAllowed, tt.wantIsRPT)
+            }
+        })
+    }
+}
@@ -0,0 +1,92 @@
+// Package logging centralizes structured logging for the auth-helper so
+// main and pkg/auth emit a single, consistent event stream (rather than
+// each calling the stdlib "log" package independently) and so ext_authz
+// calls can be correlated end-to-end via a request_id field.
+package logging
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "io"
+    "os"
+    "strings"
+    "sync/atomic"
+
+    "github.com/rs/zerolog"
+)
+
+// logger is the process-wide structured logger, reconfigured by Configure
+// once the HCL config has been parsed (and again after every hot-reload, see
+// the reload loop in main.go's main). It's held behind an atomic.Pointer rather than
+// a bare var because Configure can run concurrently with L()/WithContext()
+// calls from in-flight ext_authz streams; swapping the pointer keeps every
+// reader lock-free and consistent (either the old logger or the fully
+// built new one, never a half-constructed one). It defaults to info/text
+// so that log lines emitted before Configure runs (e.g. config-parse
+// failures) are still readable.
+var logger atomic.Pointer[zerolog.Logger]
+
+func init() {
+    l := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.InfoLevel).With().Timestamp().Logger()
+    logger.Store(&l)
+}
+
+// Configure sets the global log level and output format ("text" or
+// "json"). An unrecognized level defaults to info; an unrecognized format
+// defaults to text.
+func Configure(level, format string) {
+    lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+    if err != nil {
+        lvl = zerolog.InfoLevel
+    }
+    var out io.Writer = zerolog.ConsoleWriter{Out: os.Stderr}
+    if strings.ToLower(format) == "json" {
+        out = os.Stderr
+    }
+    l := zerolog.New(out).Level(lvl).With().Timestamp().Logger()
+    logger.Store(&l)
+}
+
+// L returns the process-wide logger.
+func L() *zerolog.Logger {
+    return logger.Load()
+}
+
+// ============================================================
+// Request correlation
+// ============================================================
+
+type ctxKeyRequestID struct{}
+
+// NewRequestID generates a short, log-friendly request correlation ID.
+func NewRequestID() string {
+    b := make([]byte, 8)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// WithRequestID attaches a request ID to ctx, generating one if id is empty.
+func WithRequestID(ctx context.Context, id string) (context.Context, string) {
+    if id == "" {
+        id = NewRequestID()
+    }
+    return context.WithValue(ctx, ctxKeyRequestID{}, id), id
+}
+
+// RequestIDFromContext returns the request ID attached to ctx, or "" if none.
+func RequestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(ctxKeyRequestID{}).(string)
+    return id
+}
+
+// WithContext returns a logger enriched with the request ID carried on ctx,
+// if any, so call sites can do logging.WithContext(ctx).Info().Msg("...").
+func WithContext(ctx context.Context) *zerolog.Logger {
+    base := logger.Load()
+    if id := RequestIDFromContext(ctx); id != "" {
+        l := base.With().Str("request_id", id).Logger()
+        return &l
+    }
+    return base
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+
+    myauth "github.com/spiffe/envoy-jwt-auth-helper/pkg/auth"
+    "github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
+    "github.com/fsnotify/fsnotify"
+)
+
+// watchReloadTriggers notifies reloadCh whenever the process receives
+// SIGHUP or the config file at path is written/renamed/recreated (common
+// with atomic-rename config management tools like confd or a ConfigMap
+// remount). A failure to start the file watcher is non-fatal; SIGHUP still
+// works.
+func watchReloadTriggers(path string, reloadCh chan<- string) {
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGHUP)
+    go func() {
+        for range sigCh {
+            reloadCh <- "SIGHUP"
+        }
+    }()
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        logging.L().Warn().Err(err).Msg("fsnotify unavailable, reload via SIGHUP only")
+        return
+    }
+    if err := watcher.Add(path); err != nil {
+        logging.L().Warn().Err(err).Str("path", path).Msg("fsnotify.Add failed, reload via SIGHUP only")
+        watcher.Close()
+        return
+    }
+    go func() {
+        for {
+            select {
+            case ev, ok := <-watcher.Events:
+                if !ok {
+                    return
+                }
+                if ev.Op&(fsnotify.Write|fsnotify.Rename|fsnotify.Create) != 0 {
+                    reloadCh <- "file-watch:" + ev.Op.String()
+                }
+            case werr, ok := <-watcher.Errors:
+                if !ok {
+                    return
+                }
+                logging.L().Warn().Err(werr).Msg("fsnotify watcher error")
+            }
+        }
+    }()
+}
+
+// reloadConfig re-reads and validates the config at path, then swaps the
+// mutable settings (the provider registry, tls.allowed_spiffe_ids) into the
+// running AuthServer and peer-authz interceptor. Immutable fields (listen,
+// mode) are logged and skipped rather than applied, since they're only read
+// once at startup (the listener and gRPC server are already bound). Returns
+// the config that is now in effect (the new one on success, the previous
+// one on failure, so the caller keeps serving with last-known-good
+// settings).
+func reloadConfig(path string, current *Config, srv *myauth.AuthServer, pai *myauth.PeerAuthzInterceptor) *Config {
+    logging.L().Info().Str("path", path).Msg("reloading config")
+    next, err := parseConfigFile(path)
+    if err != nil {
+        logging.L().Error().Err(err).Msg("config reload: parse failed, keeping previous config")
+        return current
+    }
+    if err := validate(next); err != nil {
+        logging.L().Error().Err(err).Msg("config reload: validation failed, keeping previous config")
+        return current
+    }
+
+    if next.Listen != current.Listen {
+        logging.L().Warn().Str("old", current.Listen).Str("new", next.Listen).Msg("config reload: listen is immutable after startup; restart to apply")
+        next.Listen = current.Listen
+    }
+    if next.Mode != current.Mode {
+        logging.L().Warn().Str("old", current.Mode).Str("new", next.Mode).Msg("config reload: mode is immutable after startup; restart to apply")
+        next.Mode = current.Mode
+    }
+
+    srv.SetProviders(providerSpecs(next))
+    pai.SetAllowed(allowedSPIFFEIDs(next.TLS))
+
+    logging.L().Info().Int("providers", len(next.Providers)).Msg("config reload applied")
+    return next
+}
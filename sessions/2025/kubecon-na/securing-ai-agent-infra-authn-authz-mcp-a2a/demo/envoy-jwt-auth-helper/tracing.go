@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
+    "github.com/spiffe/envoy-jwt-auth-helper/pkg/logging"
+)
+
+// TracingConfig controls the OpenTelemetry spans AuthServer.Check and its
+// outbound Keycloak calls emit (see myauth's tracing.go). Unless Disabled
+// is set, the traceparent/tracestate propagator is registered whatever
+// OTLPEndpoint says, so a span Check starts is a child of
+// the caller's own trace when Envoy forwards one - that part has no cost
+// and nothing to configure. OTLPEndpoint, when set, also registers a real
+// TracerProvider that batches spans to an OTLP/gRPC collector at that
+// endpoint (e.g. "otel-collector:4317"); when empty, spans are still
+// started against otel's no-op provider, at next to no cost, but are
+// never recorded or exported, which is the common choice while there is no
+// collector in reach. Disabled turns tracing off altogether, including the
+// propagator registration.
+type TracingConfig struct {
+    Disabled     bool   `hcl:"disabled"`
+    ServiceName  string `hcl:"service_name"`
+    OTLPEndpoint string `hcl:"otlp_endpoint"`
+    Insecure     bool   `hcl:"insecure"`
+}
+
+// setupTracing wires cfg into otel's global propagator and (if
+// cfg.OTLPEndpoint is set) a real TracerProvider that exports to an
+// OTLP/gRPC collector. It returns a shutdown func that must be called
+// (e.g. via defer) to flush and close the exporter on process exit; when
+// tracing is disabled or no exporter is configured, shutdown is a no-op.
+func setupTracing(ctx context.Context, cfg *TracingConfig) (shutdown func(context.Context) error, err error) {
+    noop := func(context.Context) error { return nil }
+    if cfg.Disabled {
+        logging.L().Info().Msg("tracing disabled")
+        return noop, nil
+    }
+    otel.SetTextMapPropagator(propagation.TraceContext{})
+
+    if cfg.OTLPEndpoint == "" {
+        logging.L().Warn().Msg("tracing.otlp_endpoint not set; spans are created but never exported")
+        return noop, nil
+    }
+
+    res, err := resource.Merge(resource.Default(),
+        resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+    if err != nil {
+        return noop, fmt.Errorf("tracing resource: %w", err)
+    }
+
+    expOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint)}
+    if cfg.Insecure {
+        expOpts = append(expOpts, otlptracegrpc.WithInsecure())
+    }
+    exporter, err := otlptracegrpc.New(ctx, expOpts...)
+    if err != nil {
+        return noop, fmt.Errorf("otlp exporter: %w", err)
+    }
+
+    tp := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(res),
+    )
+    otel.SetTracerProvider(tp)
+    logging.L().Info().Str("otlp_endpoint", cfg.OTLPEndpoint).Msg("tracing enabled")
+    return tp.Shutdown, nil
+}